@@ -0,0 +1,273 @@
+// Package api defines the request and response bodies of the pulumi_over_http REST API.
+// they're shared by the server and the Go client.
+package api
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// OperationStatus describes where an operation is in its lifecycle
+type OperationStatus string
+
+const (
+	OperationQueued    OperationStatus = "queued"
+	OperationRunning   OperationStatus = "running"
+	OperationSucceeded OperationStatus = "succeeded"
+	OperationFailed    OperationStatus = "failed"
+)
+
+type CreateSiteReq struct {
+	ID string `json:"id"`
+	// Content is the site's index document. it can be left out for templates that ignore content.
+	Content  string          `json:"content,omitempty"`
+	Template string          `json:"template,omitempty"`
+	Args     json.RawMessage `json:"args,omitempty"`
+	// Webhooks are notified whenever an operation on the site finishes
+	Webhooks []string `json:"webhooks,omitempty"`
+	// Tags are free-form labels that sites can be filtered by when listing them
+	Tags map[string]string `json:"tags,omitempty"`
+	// TTL is how long the site should live for, such as "72h". it's destroyed once it expires.
+	TTL string `json:"ttl,omitempty"`
+	// Region is the AWS region to deploy the site to, which can't be changed later
+	Region string `json:"region,omitempty"`
+	// Provider sets other provider config keys, such as "aws:skipMetadataApiCheck", from the allowed list
+	Provider map[string]string `json:"provider,omitempty"`
+	// Domain is a custom domain to serve the site from over https, which can't be changed later.
+	// it must be within one of the hosted zones the server allows.
+	Domain string `json:"domain,omitempty"`
+}
+
+type UpdateSiteReq struct {
+	// Content is the site's new index document. it can be left out for templates that ignore content.
+	Content string `json:"content,omitempty"`
+	// Args replaces the template arguments the site was deployed with, if set
+	Args json.RawMessage `json:"args,omitempty"`
+	// Webhooks replaces the site's webhooks, if set. point it at an empty list to remove them all.
+	Webhooks *[]string `json:"webhooks,omitempty"`
+	// Tags replaces the site's tags, if set. point it at an empty map to remove them all.
+	Tags *map[string]string `json:"tags,omitempty"`
+}
+
+// PatchSiteReq changes a site's settings without redeploying it
+type PatchSiteReq struct {
+	// TTL sets the site to expire this long from now. send an empty string to make it live forever.
+	TTL *string `json:"ttl"`
+}
+
+type SiteResponse struct {
+	ID        string            `json:"id"`
+	URL       string            `json:"url"`
+	Region    string            `json:"region,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	ExpiresAt *time.Time        `json:"expiresAt,omitempty"`
+	Drift     *DriftStatus      `json:"drift,omitempty"`
+	// Domain is the site's custom domain, if it has one
+	Domain string `json:"domain,omitempty"`
+	// CertificateStatus is the DNS validation status of the custom domain's certificate,
+	// PENDING_VALIDATION until ACM issues it and ISSUED after
+	CertificateStatus string `json:"certificateStatus,omitempty"`
+}
+
+type ListSitesResponse struct {
+	IDs []string `json:"ids"`
+	// Sites is only filled in with ?expand=summary
+	Sites []SiteSummary `json:"sites,omitempty"`
+	// NextCursor is passed as ?cursor= to fetch the next page, and is empty on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// SiteSummary is what the backend knows about a site's stack, without looking at its state
+type SiteSummary struct {
+	ID               string `json:"id"`
+	LastUpdate       string `json:"lastUpdate,omitempty"`
+	UpdateInProgress bool   `json:"updateInProgress"`
+	ResourceCount    *int   `json:"resourceCount,omitempty"`
+	// URL is the backend's page for the stack rather than the site's own URL. local backends don't have one.
+	URL string `json:"url,omitempty"`
+}
+
+type OperationResponse struct {
+	ID         string          `json:"id"`
+	Kind       string          `json:"kind"`
+	SiteID     string          `json:"siteId"`
+	Status     OperationStatus `json:"status"`
+	Error      *ErrorResponse  `json:"error,omitempty"`
+	Site       *SiteResponse   `json:"site,omitempty"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	StartedAt  *time.Time      `json:"startedAt,omitempty"`
+	FinishedAt *time.Time      `json:"finishedAt,omitempty"`
+	// QueueDepth is how many operations, across every site, were waiting to run when the response was made
+	QueueDepth int `json:"queueDepth"`
+	// Ahead is how many operations on the same site will run before this one, while it's queued
+	Ahead int `json:"ahead,omitempty"`
+}
+
+// WebhookPayload is POSTed to webhooks when an operation finishes
+type WebhookPayload struct {
+	OperationID     string                 `json:"operationId"`
+	Kind            string                 `json:"kind"`
+	SiteID          string                 `json:"siteId"`
+	StackName       string                 `json:"stackName"`
+	Result          OperationStatus        `json:"result"`
+	Error           *ErrorResponse         `json:"error,omitempty"`
+	StartedAt       time.Time              `json:"startedAt"`
+	FinishedAt      time.Time              `json:"finishedAt"`
+	DurationSeconds float64                `json:"durationSeconds"`
+	Outputs         map[string]interface{} `json:"outputs,omitempty"`
+}
+
+type WebhookFailure struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	OperationID string          `json:"operationId"`
+	SiteID      string          `json:"siteId"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"lastError"`
+	FailedAt    time.Time       `json:"failedAt"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+type ListWebhookFailuresResponse struct {
+	Failures []WebhookFailure `json:"failures"`
+}
+
+// ErrorResponse is the body of every error response, and the error of a failed operation
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Stack is the ID of the site the error relates to, if any
+	Stack string `json:"stack,omitempty"`
+	// Details holds the engine diagnostics from a failed update, or the problems with an invalid request
+	Details []string `json:"details,omitempty"`
+}
+
+// PendingOperation is a resource operation that was still in flight when an update was interrupted
+type PendingOperation struct {
+	URN  string `json:"urn"`
+	Type string `json:"type"`
+	Op   string `json:"op"`
+}
+
+type SiteRecoveryResponse struct {
+	ID                string             `json:"id"`
+	PendingOperations []PendingOperation `json:"pendingOperations"`
+}
+
+type ListRecoveriesResponse struct {
+	Sites []SiteRecoveryResponse `json:"sites"`
+}
+
+// AuditRecord is a mutating request as recorded in the audit log
+type AuditRecord struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	CallerID string    `json:"callerId"`
+	SiteID   string    `json:"siteId,omitempty"`
+	Stack    string    `json:"stack,omitempty"`
+	Method   string    `json:"method"`
+	Route    string    `json:"route"`
+	Path     string    `json:"path"`
+	// PayloadSHA256 is the hex SHA-256 of the request body, if it had one that wasn't too large
+	// to hash
+	PayloadSHA256   string  `json:"payloadSha256,omitempty"`
+	Status          int     `json:"status"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	// Result is accepted, rejected, or the result of the operation once it finishes
+	Result        string     `json:"result"`
+	Error         string     `json:"error,omitempty"`
+	OperationID   string     `json:"operationId,omitempty"`
+	OperationKind string     `json:"operationKind,omitempty"`
+	FinishedAt    *time.Time `json:"finishedAt,omitempty"`
+}
+
+type ListAuditResponse struct {
+	Records []AuditRecord `json:"records"`
+	// NextCursor is passed as ?cursor= to fetch the next page, and is empty on the last page
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+type ResourceChange struct {
+	URN   string   `json:"urn"`
+	Type  string   `json:"type"`
+	Op    string   `json:"op"`
+	Diffs []string `json:"diffs,omitempty"`
+}
+
+type PreviewSiteResponse struct {
+	ID      string           `json:"id"`
+	Summary map[string]int   `json:"summary"`
+	Changes []ResourceChange `json:"changes"`
+}
+
+type DriftStatus struct {
+	Drifted   bool             `json:"drifted"`
+	CheckedAt time.Time        `json:"checkedAt"`
+	Resources []ResourceChange `json:"resources,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+type DriftResponse struct {
+	ID string `json:"id"`
+	DriftStatus
+}
+
+type HistoryEntry struct {
+	Version         int            `json:"version"`
+	Kind            string         `json:"kind"`
+	Result          string         `json:"result"`
+	StartTime       string         `json:"startTime"`
+	EndTime         *string        `json:"endTime,omitempty"`
+	ResourceChanges map[string]int `json:"resourceChanges,omitempty"`
+	HasContent      bool           `json:"hasContent"`
+}
+
+type SiteHistoryResponse struct {
+	ID      string         `json:"id"`
+	Updates []HistoryEntry `json:"updates"`
+}
+
+type TemplateResponse struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Schema is the JSON schema the template's args are validated against
+	Schema json.RawMessage `json:"schema"`
+}
+
+type ListTemplatesResponse struct {
+	Templates []TemplateResponse `json:"templates"`
+}
+
+// SiteState is a site's Pulumi state, in the format of `pulumi stack export`
+type SiteState struct {
+	Version    int             `json:"version"`
+	Deployment json.RawMessage `json:"deployment"`
+}
+
+// CloneSiteReq copies a site's state and config to a new site
+type CloneSiteReq struct {
+	// ID is the new site's ID, which must not be in use
+	ID string `json:"id"`
+}
+
+// HealthResponse is the body of GET /healthz, which only says that the server is running
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// ReadinessResponse is the body of GET /readyz. Status is ready, not_ready, starting before the
+// first check has finished, or draining once the server is shutting down.
+type ReadinessResponse struct {
+	Status    string           `json:"status"`
+	CheckedAt *time.Time       `json:"checkedAt,omitempty"`
+	Checks    []ReadinessCheck `json:"checks"`
+}
+
+// ReadinessCheck is the result of one of the checks made by GET /readyz
+type ReadinessCheck struct {
+	Name string `json:"name"`
+	// Status is ok, failed, or skipped when a check it depends on failed
+	Status          string  `json:"status"`
+	Message         string  `json:"message,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
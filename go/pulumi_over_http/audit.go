@@ -0,0 +1,374 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	bolt "go.etcd.io/bbolt"
+)
+
+// the most audit records returned in a single page
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+)
+
+var (
+	// audit records keyed by a big-endian sequence number, so they're kept in the order they were made
+	auditRecordsBucket = []byte("records")
+	// operation IDs mapped to the key of the request that started them
+	auditOperationsBucket = []byte("operations")
+)
+
+// auditStore records every mutating request in a bbolt file so that who did what to which
+// site survives a restart
+type auditStore struct {
+	db *bolt.DB
+}
+
+// auditEntry is an audit record as it's stored, along with the tenant it belongs to
+type auditEntry struct {
+	Tenant string `json:"tenant,omitempty"`
+	AuditRecord
+}
+
+// audit holds the audit log, set up in main
+var audit *auditStore
+
+func openAuditStore(path string) (*auditStore, error) {
+	// don't hang forever if another server already has the file open
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{auditRecordsBucket, auditOperationsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &auditStore{db: db}, nil
+}
+
+func (a *auditStore) close() error {
+	return a.db.Close()
+}
+
+// record appends an entry to the log. if the request started an operation, the entry is
+// updated again once it finishes.
+func (a *auditStore) record(e *auditEntry) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		records := tx.Bucket(auditRecordsBucket)
+		seq, err := records.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := auditKey(seq)
+		e.ID = strconv.FormatUint(seq, 10)
+
+		if e.OperationID != "" {
+			if err := tx.Bucket(auditOperationsBucket).Put([]byte(e.OperationID), key); err != nil {
+				return err
+			}
+			// the operation may already have finished before we got here, in which case
+			// operationFinished found nothing to update
+			if op, ok := operations.get(e.Tenant, e.OperationID); ok {
+				applyOperationResult(e, op.response())
+			}
+		}
+		return putAuditEntry(records, key, e)
+	})
+}
+
+// operationFinished fills in the result of the request that started op
+func (a *auditStore) operationFinished(op *operation) {
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		key := tx.Bucket(auditOperationsBucket).Get([]byte(op.id))
+		if key == nil {
+			return nil
+		}
+		records := tx.Bucket(auditRecordsBucket)
+		var e auditEntry
+		if err := json.Unmarshal(records.Get(key), &e); err != nil {
+			return err
+		}
+		applyOperationResult(&e, op.response())
+		return putAuditEntry(records, key, &e)
+	})
+	if err != nil {
+		fmt.Printf("failed to record the result of operation %s in the audit log: %v\n", op.id, err)
+	}
+}
+
+// applyOperationResult copies the outcome of a finished operation into an entry
+func applyOperationResult(e *auditEntry, res *OperationResponse) {
+	e.OperationKind = res.Kind
+	if res.FinishedAt == nil {
+		return
+	}
+	e.Result = string(res.Status)
+	e.FinishedAt = res.FinishedAt
+	if res.Error != nil {
+		e.Error = res.Error.Message
+	}
+}
+
+// auditQuery selects the entries to return from the log
+type auditQuery struct {
+	tenant   string
+	siteID   string
+	callerID string
+	since    time.Time
+}
+
+func (q *auditQuery) matches(e *auditEntry) bool {
+	if e.Tenant != q.tenant {
+		return false
+	}
+	if q.siteID != "" && e.SiteID != q.siteID {
+		return false
+	}
+	if q.callerID != "" && e.CallerID != q.callerID {
+		return false
+	}
+	return !e.Time.Before(q.since)
+}
+
+// page returns up to limit matching records, newest first, starting before the cursor.
+// the cursor for the next page is empty once there are no more records.
+func (a *auditStore) page(q *auditQuery, cursor uint64, limit int) ([]AuditRecord, string, error) {
+	records := []AuditRecord{}
+	next := ""
+	err := a.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(auditRecordsBucket).Cursor()
+		var k, v []byte
+		if cursor == 0 {
+			k, v = c.Last()
+		} else {
+			// the cursor is the last record of the previous page, so start just before it
+			c.Seek(auditKey(cursor))
+			k, v = c.Prev()
+		}
+		for ; k != nil; k, v = c.Prev() {
+			var e auditEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if !q.matches(&e) {
+				continue
+			}
+			if len(records) == limit {
+				next = records[len(records)-1].ID
+				break
+			}
+			records = append(records, e.AuditRecord)
+		}
+		return nil
+	})
+	return records, next, err
+}
+
+// export writes every matching record to w as JSON lines, oldest first
+func (a *auditStore) export(q *auditQuery, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return a.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(auditRecordsBucket).ForEach(func(k, v []byte) error {
+			var e auditEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if !q.matches(&e) {
+				return nil
+			}
+			return enc.Encode(&e.AuditRecord)
+		})
+	})
+}
+
+func auditKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func putAuditEntry(records *bolt.Bucket, key []byte, e *auditEntry) error {
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return records.Put(key, v)
+}
+
+// auditMiddleware records every request that isn't a read, once it has been handled.
+// it runs after authentication so that the caller is known.
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" || req.Method == "HEAD" {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		start := time.Now()
+		body := &hashingReader{r: req.Body, h: sha256.New()}
+		req.Body = body
+		rec := &responseRecorder{ResponseWriter: w, status: 200}
+		next.ServeHTTP(rec, req)
+
+		c := callerFrom(req)
+		e := &auditEntry{
+			Tenant: c.Tenant,
+			AuditRecord: AuditRecord{
+				Time:            start.UTC(),
+				CallerID:        c.ID,
+				SiteID:          mux.Vars(req)["id"],
+				Method:          req.Method,
+				Path:            req.URL.Path,
+				Status:          rec.status,
+				DurationSeconds: time.Since(start).Seconds(),
+				Result:          "rejected",
+			},
+		}
+		if r := mux.CurrentRoute(req); r != nil {
+			e.Route, _ = r.GetPathTemplate()
+		}
+		if sum, ok := body.sum(); ok {
+			e.PayloadSHA256 = sum
+		}
+
+		// accepted requests return the operation they started, and rejected ones an error
+		if rec.status == 202 {
+			var res OperationResponse
+			if err := json.Unmarshal(rec.body.Bytes(), &res); err == nil {
+				e.Result = "accepted"
+				e.OperationID = res.ID
+				e.OperationKind = res.Kind
+				e.SiteID = res.SiteID
+			}
+		} else if rec.status >= 400 {
+			var res ErrorResponse
+			if err := json.Unmarshal(rec.body.Bytes(), &res); err == nil {
+				e.Error = res.Message
+				if e.SiteID == "" {
+					e.SiteID = res.Stack
+				}
+			}
+		} else {
+			e.Result = "succeeded"
+		}
+		if e.SiteID != "" {
+			e.Stack = tenantStackName(c.Tenant, e.SiteID)
+		}
+
+		if err := audit.record(e); err != nil {
+			fmt.Printf("failed to record %s %s in the audit log: %v\n", req.Method, req.URL.Path, err)
+		}
+	})
+}
+
+// hashingReader hashes a request body as the handler reads it
+type hashingReader struct {
+	r    io.ReadCloser
+	h    hash.Hash
+	read bool
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.read = true
+		r.h.Write(p[:n])
+	}
+	return n, err
+}
+
+func (r *hashingReader) Close() error {
+	return r.r.Close()
+}
+
+// maxAuditDrainBytes caps how much of a body the handler left unread is read just to hash it
+const maxAuditDrainBytes = int64(1 << 20)
+
+// sum hashes whatever the handler left unread and returns the hash of the whole body, or
+// false if the request didn't have one or too much of it was left unread to hash
+func (r *hashingReader) sum() (string, bool) {
+	n, err := io.CopyN(ioutil.Discard, r, maxAuditDrainBytes+1)
+	if err != nil && err != io.EOF {
+		return "", false
+	}
+	if !r.read || n > maxAuditDrainBytes {
+		return "", false
+	}
+	return hex.EncodeToString(r.h.Sum(nil)), true
+}
+
+// lists the audit log for the caller's tenant, newest first. ?format=jsonl exports every
+// matching record as JSON lines instead.
+func auditHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	values := req.URL.Query()
+	q := &auditQuery{
+		tenant:   callerFrom(req).Tenant,
+		siteID:   values.Get("site"),
+		callerID: values.Get("caller"),
+	}
+	if since := values.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			writeErrorf(w, 400, codeBadRequest, "", "since must be an RFC 3339 timestamp: %v", err)
+			return
+		}
+		q.since = t
+	}
+
+	if values.Get("format") == "jsonl" || strings.Contains(req.Header.Get("Accept"), "application/x-ndjson") {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if err := audit.export(q, w); err != nil {
+			// the status has most likely gone out already, so all we can do is log it
+			fmt.Printf("failed to export the audit log: %v\n", err)
+		}
+		return
+	}
+
+	limit, err := pageLimit(req, defaultAuditPageSize, maxAuditPageSize)
+	if err != nil {
+		writeError(w, "", badRequest(err))
+		return
+	}
+	var cursor uint64
+	if c := values.Get("cursor"); c != "" {
+		n, err := strconv.ParseUint(c, 10, 64)
+		if err != nil || n == 0 {
+			writeErrorf(w, 400, codeBadRequest, "", "invalid cursor %q", c)
+			return
+		}
+		cursor = n
+	}
+
+	records, next, err := audit.page(q, cursor, limit)
+	if err != nil {
+		writeError(w, "", err)
+		return
+	}
+	response := &ListAuditResponse{
+		Records:    records,
+		NextCursor: next,
+	}
+	json.NewEncoder(w).Encode(&response)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
+)
+
+// caller identifies who made a request and which tenant's sites they can see
+type caller struct {
+	ID     string
+	Tenant string
+	// Admin callers can export and import the state of their tenant's sites
+	Admin bool
+}
+
+// anonymous is the caller for every request when authentication is turned off.
+// it has no tenant, so stack names are used as site IDs unchanged, and since anyone
+// can already manage every site it's an admin.
+var anonymous = &caller{ID: "anonymous", Admin: true}
+
+// authenticator verifies the credentials on a request. it returns errNoCredentials
+// when the request doesn't carry the kind of credentials it understands.
+type authenticator interface {
+	authenticate(req *http.Request) (*caller, error)
+}
+
+var errNoCredentials = errors.New("no credentials")
+
+// tenants and site IDs are joined with a "." to form stack names, so neither may contain one
+var validName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type callerKey struct{}
+
+// authMiddleware rejects requests that none of the authenticators accept,
+// and records the caller for the handlers. with no authenticators every request is anonymous.
+func authMiddleware(authenticators []authenticator) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			c := anonymous
+			if len(authenticators) > 0 {
+				var err error
+				c, err = authenticateRequest(authenticators, req)
+				if err != nil {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="pulumi_over_http"`)
+					writeErrorf(w, 401, codeUnauthorized, "", "unauthorized: %v", err)
+					return
+				}
+			}
+			next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), callerKey{}, c)))
+		})
+	}
+}
+
+func authenticateRequest(authenticators []authenticator, req *http.Request) (*caller, error) {
+	for _, a := range authenticators {
+		c, err := a.authenticate(req)
+		if errors.Is(err, errNoCredentials) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !validName.MatchString(c.Tenant) {
+			return nil, fmt.Errorf("invalid tenant %q", c.Tenant)
+		}
+		return c, nil
+	}
+	return nil, errNoCredentials
+}
+
+// callerFrom returns the caller recorded by authMiddleware
+func callerFrom(req *http.Request) *caller {
+	if c, ok := req.Context().Value(callerKey{}).(*caller); ok {
+		return c
+	}
+	return anonymous
+}
+
+// adminOnly turns away callers who aren't admins
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !callerFrom(req).Admin {
+			writeErrorf(w, 403, codeForbidden, mux.Vars(req)["id"], "only admins can %s %s", req.Method, req.URL.Path)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// stackNameFor maps a site ID to the stack holding it for the calling tenant.
+// every tenant's stacks are namespaced so that they can never see each other's sites.
+func stackNameFor(req *http.Request, siteID string) string {
+	return tenantStackName(callerFrom(req).Tenant, siteID)
+}
+
+func tenantStackName(tenant, siteID string) string {
+	if tenant == "" {
+		return siteID
+	}
+	return tenant + "." + siteID
+}
+
+// splitStackName returns the tenant and site ID a stack was named after
+func splitStackName(stackName string) (tenant, siteID string) {
+	if i := strings.Index(stackName, "."); i >= 0 {
+		return stackName[:i], stackName[i+1:]
+	}
+	return "", stackName
+}
+
+// siteIDFor returns the site ID for a stack if it belongs to the tenant. stacks that aren't
+// named after a site, such as the scratch stacks of drift checks, don't belong to anyone.
+func siteIDFor(tenant, stackName string) (string, bool) {
+	siteID := stackName
+	if tenant != "" {
+		prefix := tenant + "."
+		if !strings.HasPrefix(stackName, prefix) {
+			return "", false
+		}
+		siteID = strings.TrimPrefix(stackName, prefix)
+	}
+	return siteID, !isDriftStack(siteID)
+}
+
+// bearerToken pulls the token out of an "Authorization: Bearer <token>" header
+func bearerToken(req *http.Request) string {
+	h := req.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// apiKey is an entry in the API keys file
+type apiKey struct {
+	Key    string `json:"key"`
+	Name   string `json:"name"`
+	Tenant string `json:"tenant"`
+	Admin  bool   `json:"admin,omitempty"`
+}
+
+// apiKeyAuthenticator accepts static API keys, sent either as a bearer token or an X-API-Key header
+type apiKeyAuthenticator struct {
+	keys []apiKey
+}
+
+// newAPIKeyAuthenticator loads API keys from a JSON file of the form
+// [{"key": "...", "name": "ci-bot", "tenant": "acme", "admin": false}]
+func newAPIKeyAuthenticator(path string) (*apiKeyAuthenticator, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []apiKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse API keys file %q: %w", path, err)
+	}
+	for i, k := range keys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("API key %d in %q is empty", i, path)
+		}
+		if !validName.MatchString(k.Tenant) {
+			return nil, fmt.Errorf("API key %q in %q has invalid tenant %q", k.Name, path, k.Tenant)
+		}
+	}
+	return &apiKeyAuthenticator{keys: keys}, nil
+}
+
+func (a *apiKeyAuthenticator) authenticate(req *http.Request) (*caller, error) {
+	presented := req.Header.Get("X-API-Key")
+	if presented == "" {
+		presented = bearerToken(req)
+	}
+	if presented == "" {
+		return nil, errNoCredentials
+	}
+	// JWTs are also sent as bearer tokens, so leave them to the JWT authenticator
+	if strings.Count(presented, ".") == 2 {
+		return nil, errNoCredentials
+	}
+
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(k.Key)) == 1 {
+			return &caller{ID: k.Name, Tenant: k.Tenant, Admin: k.Admin}, nil
+		}
+	}
+	return nil, errors.New("invalid API key")
+}
+
+// jwtAuthenticator accepts HMAC-signed JWTs, verified locally with a shared secret.
+// the "sub" claim identifies the caller, the "tenant" claim their tenant, and an "admin" claim of
+// true makes them an admin. tokens must expire, and aren't accepted before their "nbf" or "iat".
+type jwtAuthenticator struct {
+	secret []byte
+}
+
+func newJWTAuthenticator(secret string) *jwtAuthenticator {
+	return &jwtAuthenticator{secret: []byte(secret)}
+}
+
+type siteClaims struct {
+	jwt.StandardClaims
+	Tenant string `json:"tenant"`
+	Admin  bool   `json:"admin"`
+}
+
+func (a *jwtAuthenticator) authenticate(req *http.Request) (*caller, error) {
+	raw := bearerToken(req)
+	if raw == "" || strings.Count(raw, ".") != 2 {
+		return nil, errNoCredentials
+	}
+
+	var claims siteClaims
+	_, err := jwt.ParseWithClaims(raw, &claims, func(t *jwt.Token) (interface{}, error) {
+		// only accept HMAC signatures, otherwise a token could pick its own verification method
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %q", t.Header["alg"])
+		}
+		return a.secret, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	// the library only checks exp, nbf, and iat when they're set, and a token that never
+	// expires can't be revoked short of changing the secret
+	if claims.ExpiresAt == 0 {
+		return nil, errors.New("invalid token: missing exp claim")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("invalid token: missing sub claim")
+	}
+	return &caller{ID: claims.Subject, Tenant: claims.Tenant, Admin: claims.Admin}, nil
+}
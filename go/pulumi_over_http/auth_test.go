@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestJWTAuthenticator(t *testing.T) {
+	a := newJWTAuthenticator("secret")
+	now := time.Now()
+	valid := jwt.StandardClaims{Subject: "ci-bot", ExpiresAt: now.Add(time.Hour).Unix()}
+	tests := []struct {
+		name   string
+		claims func(c *jwt.StandardClaims)
+		ok     bool
+	}{
+		{"valid", func(c *jwt.StandardClaims) {}, true},
+		{"issued and valid already", func(c *jwt.StandardClaims) {
+			c.IssuedAt = now.Add(-time.Minute).Unix()
+			c.NotBefore = now.Add(-time.Minute).Unix()
+		}, true},
+		{"missing exp", func(c *jwt.StandardClaims) { c.ExpiresAt = 0 }, false},
+		{"expired", func(c *jwt.StandardClaims) { c.ExpiresAt = now.Add(-time.Minute).Unix() }, false},
+		{"not valid yet", func(c *jwt.StandardClaims) { c.NotBefore = now.Add(time.Hour).Unix() }, false},
+		{"issued in the future", func(c *jwt.StandardClaims) { c.IssuedAt = now.Add(time.Hour).Unix() }, false},
+		{"missing sub", func(c *jwt.StandardClaims) { c.Subject = "" }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := siteClaims{StandardClaims: valid, Tenant: "acme"}
+			tt.claims(&claims.StandardClaims)
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest("GET", "/sites", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			c, err := a.authenticate(req)
+			if tt.ok && (err != nil || c.ID != "ci-bot" || c.Tenant != "acme") {
+				t.Fatalf("expected the token to be accepted, got %+v, %v", c, err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatalf("expected the token to be rejected, got %+v", c)
+			}
+		})
+	}
+}
@@ -0,0 +1,544 @@
+// Package client is a Go client for the pulumi_over_http REST API.
+//
+// mutations are asynchronous: creates, updates, deletes, refreshes, rollbacks, and recoveries
+// return the operation they started, which can be followed with WaitForOperation.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pulumi/automation-api-examples/go/pulumi_over_http/api"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+const (
+	// DefaultTimeout bounds requests that return straight away, including the ones that
+	// start a deployment, since deployments run in the background
+	DefaultTimeout = time.Minute
+	// DefaultLongTimeout bounds requests that run the Pulumi CLI before responding,
+	// such as previews
+	DefaultLongTimeout = 30 * time.Minute
+)
+
+// errors returned for the corresponding statuses. use errors.Is to check for them, and
+// errors.As with *Error for the details.
+var (
+	ErrForbidden          = errors.New("forbidden")
+	ErrNotFound           = errors.New("not found")
+	ErrConflict           = errors.New("conflict")
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// Error is a non-2xx response from the server
+type Error struct {
+	StatusCode int
+	api.ErrorResponse
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrForbidden:
+		return e.StatusCode == 403
+	case ErrNotFound:
+		return e.StatusCode == 404
+	case ErrConflict:
+		return e.StatusCode == 409
+	case ErrPreconditionFailed:
+		return e.StatusCode == 412
+	}
+	return false
+}
+
+// Client talks to a pulumi_over_http server
+type Client struct {
+	// BaseURL is where the server is listening, such as http://localhost:1337
+	BaseURL string
+	// APIKey is sent in the X-API-Key header, if set
+	APIKey string
+	// Token is sent as a bearer token, if set
+	Token string
+
+	HTTPClient  *http.Client
+	Timeout     time.Duration
+	LongTimeout time.Duration
+}
+
+// New returns a client for the server at baseURL
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:     strings.TrimRight(baseURL, "/"),
+		HTTPClient:  &http.Client{},
+		Timeout:     DefaultTimeout,
+		LongTimeout: DefaultLongTimeout,
+	}
+}
+
+// RequestOption adds optional headers to a request
+type RequestOption func(req *http.Request)
+
+// WithIdempotencyKey makes a create, update, or clone safe to retry
+func WithIdempotencyKey(key string) RequestOption {
+	return func(req *http.Request) {
+		req.Header.Set("Idempotency-Key", key)
+	}
+}
+
+// WithIfMatch makes an update, patch, delete, or state import fail with ErrPreconditionFailed
+// if the site has changed since the ETag was returned by GetSite or ExportState
+func WithIfMatch(etag string) RequestOption {
+	return func(req *http.Request) {
+		req.Header.Set("If-Match", etag)
+	}
+}
+
+// CreateSite starts deploying a new site
+func (c *Client) CreateSite(ctx context.Context, site *api.CreateSiteReq, opts ...RequestOption) (*api.OperationResponse, error) {
+	var op api.OperationResponse
+	if _, err := c.do(ctx, c.Timeout, "POST", "/sites", nil, site, &op, opts...); err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+// ListSitesOptions filters and pages through GET /sites. the zero value lists the first page.
+type ListSitesOptions struct {
+	Prefix        string
+	Tags          map[string]string
+	UpdatedSince  time.Time
+	UpdatedBefore time.Time
+	// Expand includes a summary of each site's stack
+	Expand bool
+	Limit  int
+	Cursor string
+}
+
+// ListSites returns a page of sites. pass the NextCursor of the response as Cursor to get the next page.
+func (c *Client) ListSites(ctx context.Context, opts *ListSitesOptions) (*api.ListSitesResponse, error) {
+	query := url.Values{}
+	if opts != nil {
+		setQuery(query, "prefix", opts.Prefix)
+		for k, v := range opts.Tags {
+			if v == "" {
+				query.Add("tag", k)
+			} else {
+				query.Add("tag", k+"="+v)
+			}
+		}
+		setTimeQuery(query, "updatedSince", opts.UpdatedSince)
+		setTimeQuery(query, "updatedBefore", opts.UpdatedBefore)
+		if opts.Expand {
+			query.Set("expand", "summary")
+		}
+		setIntQuery(query, "limit", opts.Limit)
+		setQuery(query, "cursor", opts.Cursor)
+	}
+	var res api.ListSitesResponse
+	if _, err := c.do(ctx, c.Timeout, "GET", "/sites", query, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// GetSite returns a site along with its ETag, for use with WithIfMatch
+func (c *Client) GetSite(ctx context.Context, id string) (*api.SiteResponse, string, error) {
+	var site api.SiteResponse
+	header, err := c.do(ctx, c.Timeout, "GET", sitePath(id), nil, nil, &site)
+	if err != nil {
+		return nil, "", err
+	}
+	return &site, header.Get("ETag"), nil
+}
+
+// UpdateSite starts redeploying a site with new content
+func (c *Client) UpdateSite(ctx context.Context, id string, site *api.UpdateSiteReq, opts ...RequestOption) (*api.OperationResponse, error) {
+	var op api.OperationResponse
+	if _, err := c.do(ctx, c.Timeout, "PUT", sitePath(id), nil, site, &op, opts...); err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+// PatchSite changes a site's settings without redeploying it
+func (c *Client) PatchSite(ctx context.Context, id string, patch *api.PatchSiteReq, opts ...RequestOption) (*api.SiteResponse, error) {
+	var site api.SiteResponse
+	if _, err := c.do(ctx, c.Timeout, "PATCH", sitePath(id), nil, patch, &site, opts...); err != nil {
+		return nil, err
+	}
+	return &site, nil
+}
+
+// DeleteSite starts destroying a site
+func (c *Client) DeleteSite(ctx context.Context, id string, opts ...RequestOption) (*api.OperationResponse, error) {
+	var op api.OperationResponse
+	if _, err := c.do(ctx, c.Timeout, "DELETE", sitePath(id), nil, nil, &op, opts...); err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+// PreviewSite returns the changes an update would make, without making them
+func (c *Client) PreviewSite(ctx context.Context, id string, site *api.UpdateSiteReq) (*api.PreviewSiteResponse, error) {
+	var res api.PreviewSiteResponse
+	if _, err := c.do(ctx, c.LongTimeout, "POST", sitePath(id)+"/preview", nil, site, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// RefreshSite starts a refresh that adopts changes made to the site's resources outside of Pulumi
+func (c *Client) RefreshSite(ctx context.Context, id string) (*api.OperationResponse, error) {
+	var op api.OperationResponse
+	if _, err := c.do(ctx, c.Timeout, "POST", sitePath(id)+"/refresh", nil, nil, &op); err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+// GetDrift checks which of a site's resources have been changed outside of Pulumi, without
+// changing the site
+func (c *Client) GetDrift(ctx context.Context, id string) (*api.DriftResponse, error) {
+	var res api.DriftResponse
+	if _, err := c.do(ctx, c.LongTimeout, "GET", sitePath(id)+"/drift", nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// GetHistory returns a page of a site's updates, newest first. a pageSize of 0 returns them all.
+func (c *Client) GetHistory(ctx context.Context, id string, pageSize, page int) (*api.SiteHistoryResponse, error) {
+	query := url.Values{}
+	setIntQuery(query, "pageSize", pageSize)
+	setIntQuery(query, "page", page)
+	var res api.SiteHistoryResponse
+	if _, err := c.do(ctx, c.Timeout, "GET", sitePath(id)+"/history", query, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Rollback starts redeploying a site as it was at an earlier version
+func (c *Client) Rollback(ctx context.Context, id string, version int) (*api.OperationResponse, error) {
+	query := url.Values{"version": {strconv.Itoa(version)}}
+	var op api.OperationResponse
+	if _, err := c.do(ctx, c.Timeout, "POST", sitePath(id)+"/rollback", query, nil, &op); err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+// ListRecoveries returns the sites left with pending operations when the server last stopped
+func (c *Client) ListRecoveries(ctx context.Context) (*api.ListRecoveriesResponse, error) {
+	var res api.ListRecoveriesResponse
+	if _, err := c.do(ctx, c.Timeout, "GET", "/recovery", nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// GetRecovery returns the operations left pending in a site's state
+func (c *Client) GetRecovery(ctx context.Context, id string) (*api.SiteRecoveryResponse, error) {
+	var res api.SiteRecoveryResponse
+	if _, err := c.do(ctx, c.Timeout, "GET", sitePath(id)+"/recovery", nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Recover starts clearing a site's pending operations and refreshing it
+func (c *Client) Recover(ctx context.Context, id string) (*api.OperationResponse, error) {
+	var op api.OperationResponse
+	if _, err := c.do(ctx, c.Timeout, "POST", sitePath(id)+"/recover", nil, nil, &op); err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+// ExportState returns a site's Pulumi state along with its ETag, for use with WithIfMatch.
+// only admins can export state.
+func (c *Client) ExportState(ctx context.Context, id string) (*api.SiteState, string, error) {
+	var state api.SiteState
+	header, err := c.do(ctx, c.LongTimeout, "GET", sitePath(id)+"/state", nil, nil, &state)
+	if err != nil {
+		return nil, "", err
+	}
+	return &state, header.Get("ETag"), nil
+}
+
+// ImportState replaces a site's Pulumi state, once the operations queued on the site have
+// finished. only admins can import state.
+func (c *Client) ImportState(ctx context.Context, id string, state *api.SiteState, opts ...RequestOption) (*api.SiteResponse, error) {
+	var site api.SiteResponse
+	if _, err := c.do(ctx, c.LongTimeout, "PUT", sitePath(id)+"/state", nil, state, &site, opts...); err != nil {
+		return nil, err
+	}
+	return &site, nil
+}
+
+// CloneSite copies a site's state and config to a new site that manages the same resources.
+// only admins can clone sites.
+func (c *Client) CloneSite(ctx context.Context, id, newID string, opts ...RequestOption) (*api.SiteResponse, error) {
+	var site api.SiteResponse
+	if _, err := c.do(ctx, c.LongTimeout, "POST", sitePath(id)+"/clone", nil, &api.CloneSiteReq{ID: newID}, &site, opts...); err != nil {
+		return nil, err
+	}
+	return &site, nil
+}
+
+// GetOperation returns the current status of an operation
+func (c *Client) GetOperation(ctx context.Context, id string) (*api.OperationResponse, error) {
+	var op api.OperationResponse
+	if _, err := c.do(ctx, c.Timeout, "GET", "/operations/"+url.PathEscape(id), nil, nil, &op); err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+// WaitForOperation polls an operation every interval until it finishes or ctx is done.
+// a failed operation is returned without an error, check its Status and Error.
+func (c *Client) WaitForOperation(ctx context.Context, id string, interval time.Duration) (*api.OperationResponse, error) {
+	for {
+		op, err := c.GetOperation(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if op.Status == api.OperationSucceeded || op.Status == api.OperationFailed {
+			return op, nil
+		}
+		select {
+		case <-ctx.Done():
+			return op, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// StreamEvents calls fn with each engine event of an operation as it happens, returning once
+// the operation has finished. there's no timeout other than ctx.
+func (c *Client) StreamEvents(ctx context.Context, siteID, opID string, fn func(apitype.EngineEvent)) (*api.OperationResponse, error) {
+	req, err := c.newRequest(ctx, "GET", sitePath(siteID)+"/operations/"+url.PathEscape(opID)+"/events", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return nil, readError(res)
+	}
+
+	// server-sent events are blocks of "field: value" lines separated by blank lines
+	var event string
+	var data bytes.Buffer
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			switch event {
+			case "engineEvent":
+				var e apitype.EngineEvent
+				if err := json.Unmarshal(data.Bytes(), &e); err != nil {
+					return nil, fmt.Errorf("failed to decode engine event: %w", err)
+				}
+				fn(e)
+			case "done":
+				var op api.OperationResponse
+				if err := json.Unmarshal(data.Bytes(), &op); err != nil {
+					return nil, fmt.Errorf("failed to decode operation: %w", err)
+				}
+				return &op, nil
+			}
+			event = ""
+			data.Reset()
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data.WriteString(strings.TrimPrefix(line, "data: "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+// ListTemplates returns the templates sites can be created from
+func (c *Client) ListTemplates(ctx context.Context) (*api.ListTemplatesResponse, error) {
+	var res api.ListTemplatesResponse
+	if _, err := c.do(ctx, c.Timeout, "GET", "/templates", nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ListWebhookFailures returns the webhook deliveries that ran out of attempts
+func (c *Client) ListWebhookFailures(ctx context.Context) (*api.ListWebhookFailuresResponse, error) {
+	var res api.ListWebhookFailuresResponse
+	if _, err := c.do(ctx, c.Timeout, "GET", "/webhooks/failures", nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// AuditOptions filters and pages through the audit log
+type AuditOptions struct {
+	SiteID   string
+	CallerID string
+	Since    time.Time
+	Limit    int
+	Cursor   string
+}
+
+func (opts *AuditOptions) query() url.Values {
+	query := url.Values{}
+	if opts != nil {
+		setQuery(query, "site", opts.SiteID)
+		setQuery(query, "caller", opts.CallerID)
+		setTimeQuery(query, "since", opts.Since)
+		setIntQuery(query, "limit", opts.Limit)
+		setQuery(query, "cursor", opts.Cursor)
+	}
+	return query
+}
+
+// ListAudit returns a page of the audit log, newest first
+func (c *Client) ListAudit(ctx context.Context, opts *AuditOptions) (*api.ListAuditResponse, error) {
+	var res api.ListAuditResponse
+	if _, err := c.do(ctx, c.Timeout, "GET", "/audit", opts.query(), nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// ExportAudit copies every matching audit record to w as JSON lines, oldest first.
+// the limit and cursor are ignored.
+func (c *Client) ExportAudit(ctx context.Context, opts *AuditOptions, w io.Writer) error {
+	query := opts.query()
+	query.Set("format", "jsonl")
+	ctx, cancel := context.WithTimeout(ctx, c.LongTimeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, "GET", "/audit", query, nil)
+	if err != nil {
+		return err
+	}
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return readError(res)
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// do sends a request with a JSON body, if any, and decodes the JSON response into out
+func (c *Client) do(ctx context.Context, timeout time.Duration, method, path string, query url.Values, body, out interface{}, opts ...RequestOption) (http.Header, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := c.newRequest(ctx, method, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		opt(req)
+	}
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return res.Header, readError(res)
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return res.Header, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return res.Header, nil
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, query url.Values, body interface{}) (*http.Request, error) {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	return req, nil
+}
+
+// readError decodes the JSON error body of a failed request
+func readError(res *http.Response) error {
+	e := &Error{StatusCode: res.StatusCode}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err == nil && json.Unmarshal(data, &e.ErrorResponse) != nil {
+		// not one of our error bodies, perhaps from a proxy in front of the server
+		e.Message = strings.TrimSpace(string(data))
+	}
+	return e
+}
+
+func sitePath(id string) string {
+	return "/sites/" + url.PathEscape(id)
+}
+
+func setQuery(query url.Values, name, value string) {
+	if value != "" {
+		query.Set(name, value)
+	}
+}
+
+func setIntQuery(query url.Values, name string, value int) {
+	if value != 0 {
+		query.Set(name, strconv.Itoa(value))
+	}
+}
+
+func setTimeQuery(query url.Values, name string, value time.Time) {
+	if !value.IsZero() {
+		query.Set(name, value.Format(time.RFC3339))
+	}
+}
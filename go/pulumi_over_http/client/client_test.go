@@ -0,0 +1,52 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pulumi/automation-api-examples/go/pulumi_over_http/api"
+)
+
+// updates leave out the webhooks and tags they don't set, and send the empty ones that clear them
+func TestUpdateSiteWebhooksAndTags(t *testing.T) {
+	var body map[string]json.RawMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		body = nil
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("failed to parse request body %s: %v", data, err)
+		}
+		w.WriteHeader(202)
+		json.NewEncoder(w).Encode(&api.OperationResponse{ID: "op", Kind: "update", SiteID: "a"})
+	}))
+	defer server.Close()
+	c := New(server.URL)
+	ctx := context.Background()
+
+	if _, err := c.UpdateSite(ctx, "a", &api.UpdateSiteReq{Content: "hi"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := body["webhooks"]; ok {
+		t.Fatalf("expected webhooks to be left out, got %s", body["webhooks"])
+	}
+	if _, ok := body["tags"]; ok {
+		t.Fatalf("expected tags to be left out, got %s", body["tags"])
+	}
+
+	if _, err := c.UpdateSite(ctx, "a", &api.UpdateSiteReq{Content: "hi", Webhooks: &[]string{}, Tags: &map[string]string{}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(body["webhooks"]); got != "[]" {
+		t.Fatalf("expected an empty list of webhooks, got %q", got)
+	}
+	if got := string(body["tags"]); got != "{}" {
+		t.Fatalf("expected an empty set of tags, got %q", got)
+	}
+}
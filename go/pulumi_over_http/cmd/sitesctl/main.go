@@ -0,0 +1,440 @@
+// sitesctl manages sites on a pulumi_over_http server
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulumi/automation-api-examples/go/pulumi_over_http/api"
+	"github.com/pulumi/automation-api-examples/go/pulumi_over_http/client"
+)
+
+func main() {
+	if err := newRootCmd().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func newRootCmd() *cobra.Command {
+	var server, apiKey, token string
+	var c *client.Client
+
+	root := &cobra.Command{
+		Use:          "sitesctl",
+		Short:        "Manage sites on a pulumi_over_http server",
+		SilenceUsage: true,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			c = client.New(server)
+			c.APIKey = apiKey
+			c.Token = token
+		},
+	}
+	root.PersistentFlags().StringVar(&server, "server", envOr("SITES_SERVER", "http://localhost:1337"), "server URL, defaults to $SITES_SERVER")
+	root.PersistentFlags().StringVar(&apiKey, "api-key", os.Getenv("SITES_API_KEY"), "API key, defaults to $SITES_API_KEY")
+	root.PersistentFlags().StringVar(&token, "token", os.Getenv("SITES_TOKEN"), "bearer token, defaults to $SITES_TOKEN")
+
+	// the client is only built once the flags have been parsed
+	getClient := func() *client.Client { return c }
+	root.AddCommand(
+		newCreateCmd(getClient),
+		newListCmd(getClient),
+		newGetCmd(getClient),
+		newUpdateCmd(getClient),
+		newDeleteCmd(getClient),
+		newStateCmd(getClient),
+		newCloneCmd(getClient),
+	)
+	return root
+}
+
+// siteFlags are the flags shared by create and update
+type siteFlags struct {
+	content     string
+	contentFile string
+	args        string
+	webhooks    []string
+	tags        []string
+}
+
+func (f *siteFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.content, "content", "", "HTML to serve as the site's index document")
+	cmd.Flags().StringVar(&f.contentFile, "content-file", "", "file to read the index document from")
+	cmd.Flags().StringVar(&f.args, "args", "", "template arguments as a JSON object")
+	cmd.Flags().StringSliceVar(&f.webhooks, "webhook", nil, "webhook to notify when operations on the site finish, can be repeated")
+	cmd.Flags().StringSliceVar(&f.tags, "tag", nil, "tag as key=value, can be repeated")
+}
+
+func (f *siteFlags) readContent() (string, error) {
+	if f.contentFile == "" {
+		return f.content, nil
+	}
+	data, err := ioutil.ReadFile(f.contentFile)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (f *siteFlags) readArgs() (json.RawMessage, error) {
+	if f.args == "" {
+		return nil, nil
+	}
+	if !json.Valid([]byte(f.args)) {
+		return nil, fmt.Errorf("--args must be valid JSON")
+	}
+	return json.RawMessage(f.args), nil
+}
+
+// waitFlags let mutations follow the operation they start to the end
+type waitFlags struct {
+	wait     bool
+	interval time.Duration
+}
+
+func (f *waitFlags) register(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&f.wait, "wait", false, "wait for the operation to finish")
+	cmd.Flags().DurationVar(&f.interval, "poll-interval", 2*time.Second, "how often to check on the operation with --wait")
+}
+
+// finish prints the operation, after waiting for it if asked to, and fails if it did
+func (f *waitFlags) finish(ctx context.Context, c *client.Client, op *api.OperationResponse) error {
+	if f.wait {
+		var err error
+		if op, err = c.WaitForOperation(ctx, op.ID, f.interval); err != nil {
+			return err
+		}
+	}
+	if err := printJSON(op); err != nil {
+		return err
+	}
+	if op.Status == api.OperationFailed {
+		return fmt.Errorf("operation %s failed", op.ID)
+	}
+	return nil
+}
+
+func newCreateCmd(c func() *client.Client) *cobra.Command {
+	var site siteFlags
+	var wait waitFlags
+	var template, region, domain, ttl, idempotencyKey string
+	cmd := &cobra.Command{
+		Use:   "create ID",
+		Short: "Create a site",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			content, err := site.readContent()
+			if err != nil {
+				return err
+			}
+			templateArgs, err := site.readArgs()
+			if err != nil {
+				return err
+			}
+			tags, err := parseKeyValues(site.tags)
+			if err != nil {
+				return err
+			}
+			var opts []client.RequestOption
+			if idempotencyKey != "" {
+				opts = append(opts, client.WithIdempotencyKey(idempotencyKey))
+			}
+			ctx := context.Background()
+			op, err := c().CreateSite(ctx, &api.CreateSiteReq{
+				ID:       args[0],
+				Content:  content,
+				Template: template,
+				Args:     templateArgs,
+				Webhooks: site.webhooks,
+				Tags:     tags,
+				TTL:      ttl,
+				Region:   region,
+				Domain:   domain,
+			}, opts...)
+			if err != nil {
+				return err
+			}
+			return wait.finish(ctx, c(), op)
+		},
+	}
+	site.register(cmd)
+	wait.register(cmd)
+	cmd.Flags().StringVar(&template, "template", "", "template to build the site from")
+	cmd.Flags().StringVar(&region, "region", "", "AWS region to deploy the site to")
+	cmd.Flags().StringVar(&domain, "domain", "", "custom domain to serve the site from")
+	cmd.Flags().StringVar(&ttl, "ttl", "", "how long the site should live for, such as 72h")
+	cmd.Flags().StringVar(&idempotencyKey, "idempotency-key", "", "key that makes the request safe to retry")
+	return cmd
+}
+
+func newListCmd(c func() *client.Client) *cobra.Command {
+	var opts client.ListSitesOptions
+	var tags []string
+	var all bool
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List sites",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			if opts.Tags, err = parseTagFilters(tags); err != nil {
+				return err
+			}
+			ctx := context.Background()
+			res, err := c().ListSites(ctx, &opts)
+			if err != nil {
+				return err
+			}
+			// follow the cursor to the end when asked for every page
+			for all && res.NextCursor != "" {
+				opts.Cursor = res.NextCursor
+				page, err := c().ListSites(ctx, &opts)
+				if err != nil {
+					return err
+				}
+				res.IDs = append(res.IDs, page.IDs...)
+				res.Sites = append(res.Sites, page.Sites...)
+				res.NextCursor = page.NextCursor
+			}
+			return printJSON(res)
+		},
+	}
+	cmd.Flags().StringVar(&opts.Prefix, "prefix", "", "only list sites whose ID starts with this")
+	cmd.Flags().StringSliceVar(&tags, "tag", nil, "only list sites with this tag, as key=value or key, can be repeated")
+	cmd.Flags().BoolVar(&opts.Expand, "summary", false, "include a summary of each site's stack")
+	cmd.Flags().IntVar(&opts.Limit, "limit", 0, "most sites to return per page")
+	cmd.Flags().StringVar(&opts.Cursor, "cursor", "", "cursor returned by the previous page")
+	cmd.Flags().BoolVar(&all, "all", false, "fetch every page")
+	return cmd
+}
+
+func newGetCmd(c func() *client.Client) *cobra.Command {
+	return &cobra.Command{
+		Use:   "get ID",
+		Short: "Show a site",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			site, etag, err := c().GetSite(context.Background(), args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "ETag: %s\n", etag)
+			return printJSON(site)
+		},
+	}
+}
+
+func newUpdateCmd(c func() *client.Client) *cobra.Command {
+	var site siteFlags
+	var wait waitFlags
+	var ifMatch, idempotencyKey string
+	cmd := &cobra.Command{
+		Use:   "update ID",
+		Short: "Redeploy a site with new content",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			content, err := site.readContent()
+			if err != nil {
+				return err
+			}
+			templateArgs, err := site.readArgs()
+			if err != nil {
+				return err
+			}
+			req := &api.UpdateSiteReq{
+				Content: content,
+				Args:    templateArgs,
+			}
+			// only replace the webhooks and tags when they're given. --webhook "" and --tag ""
+			// remove them all.
+			if cmd.Flags().Changed("webhook") {
+				webhooks := append([]string{}, site.webhooks...)
+				req.Webhooks = &webhooks
+			}
+			if cmd.Flags().Changed("tag") {
+				tags, err := parseKeyValues(site.tags)
+				if err != nil {
+					return err
+				}
+				if tags == nil {
+					tags = map[string]string{}
+				}
+				req.Tags = &tags
+			}
+			var opts []client.RequestOption
+			if ifMatch != "" {
+				opts = append(opts, client.WithIfMatch(ifMatch))
+			}
+			if idempotencyKey != "" {
+				opts = append(opts, client.WithIdempotencyKey(idempotencyKey))
+			}
+			ctx := context.Background()
+			op, err := c().UpdateSite(ctx, args[0], req, opts...)
+			if err != nil {
+				return err
+			}
+			return wait.finish(ctx, c(), op)
+		},
+	}
+	site.register(cmd)
+	wait.register(cmd)
+	cmd.Flags().StringVar(&ifMatch, "if-match", "", "only update the site if its ETag still matches")
+	cmd.Flags().StringVar(&idempotencyKey, "idempotency-key", "", "key that makes the request safe to retry")
+	return cmd
+}
+
+func newDeleteCmd(c func() *client.Client) *cobra.Command {
+	var wait waitFlags
+	var ifMatch string
+	cmd := &cobra.Command{
+		Use:   "delete ID",
+		Short: "Destroy a site",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var opts []client.RequestOption
+			if ifMatch != "" {
+				opts = append(opts, client.WithIfMatch(ifMatch))
+			}
+			ctx := context.Background()
+			op, err := c().DeleteSite(ctx, args[0], opts...)
+			if err != nil {
+				return err
+			}
+			return wait.finish(ctx, c(), op)
+		},
+	}
+	wait.register(cmd)
+	cmd.Flags().StringVar(&ifMatch, "if-match", "", "only delete the site if its ETag still matches")
+	return cmd
+}
+
+func newStateCmd(c func() *client.Client) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "state",
+		Short: "Export or import a site's Pulumi state, admins only",
+	}
+
+	export := &cobra.Command{
+		Use:   "export ID",
+		Short: "Print a site's state",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			state, etag, err := c().ExportState(context.Background(), args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "ETag: %s\n", etag)
+			return printJSON(state)
+		},
+	}
+
+	var ifMatch string
+	importCmd := &cobra.Command{
+		Use:   "import ID FILE",
+		Short: "Replace a site's state with an exported one, read from FILE or - for stdin",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var data []byte
+			var err error
+			if args[1] == "-" {
+				data, err = ioutil.ReadAll(os.Stdin)
+			} else {
+				data, err = ioutil.ReadFile(args[1])
+			}
+			if err != nil {
+				return err
+			}
+			var state api.SiteState
+			if err := json.Unmarshal(data, &state); err != nil {
+				return fmt.Errorf("failed to parse %s: %w", args[1], err)
+			}
+			var opts []client.RequestOption
+			if ifMatch != "" {
+				opts = append(opts, client.WithIfMatch(ifMatch))
+			}
+			site, err := c().ImportState(context.Background(), args[0], &state, opts...)
+			if err != nil {
+				return err
+			}
+			return printJSON(site)
+		},
+	}
+	importCmd.Flags().StringVar(&ifMatch, "if-match", "", "only import the state if the site's ETag still matches")
+
+	cmd.AddCommand(export, importCmd)
+	return cmd
+}
+
+func newCloneCmd(c func() *client.Client) *cobra.Command {
+	var idempotencyKey string
+	cmd := &cobra.Command{
+		Use:   "clone ID NEW_ID",
+		Short: "Copy a site's state and config to a new site, admins only",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var opts []client.RequestOption
+			if idempotencyKey != "" {
+				opts = append(opts, client.WithIdempotencyKey(idempotencyKey))
+			}
+			site, err := c().CloneSite(context.Background(), args[0], args[1], opts...)
+			if err != nil {
+				return err
+			}
+			return printJSON(site)
+		},
+	}
+	cmd.Flags().StringVar(&idempotencyKey, "idempotency-key", "", "key that makes the request safe to retry")
+	return cmd
+}
+
+// parseKeyValues parses key=value flags into a map
+func parseKeyValues(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	m := make(map[string]string)
+	for _, p := range pairs {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid tag %q, must be key=value", p)
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
+
+// parseTagFilters parses key=value or key filters, where a key alone matches any value
+func parseTagFilters(filters []string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, f := range filters {
+		kv := strings.SplitN(f, "=", 2)
+		if kv[0] == "" {
+			return nil, fmt.Errorf("invalid tag filter %q", f)
+		}
+		if len(kv) == 2 {
+			m[kv[0]] = kv[1]
+		} else {
+			m[kv[0]] = ""
+		}
+	}
+	return m, nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// limits on what can be uploaded to a single site, set by flags in main
+var (
+	maxUploadFiles = 1000
+	maxUploadBytes = int64(50 << 20)
+)
+
+// siteContent is what gets uploaded to a site's bucket. content sent through the JSON API
+// is a single index document, while multipart forms and tarballs carry a set of files.
+type siteContent struct {
+	Index string            `json:"index,omitempty"`
+	Files map[string][]byte `json:"files,omitempty"`
+}
+
+// contentStore keeps the content deployed by each update on disk, keyed by its SHA-256 hash.
+// uploads can be far too large to record in stack config, so config records the hash instead.
+type contentStore struct {
+	dir string
+}
+
+// contents is where the server keeps site content, set up in main
+var contents *contentStore
+
+func newContentStore(dir string) (*contentStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &contentStore{dir: dir}, nil
+}
+
+// put saves the content if it isn't already stored and returns its hash
+func (c *contentStore) put(content *siteContent) (string, error) {
+	data, err := json.Marshal(content)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	p := filepath.Join(c.dir, hash+".json")
+	if _, err := os.Stat(p); err == nil {
+		return hash, nil
+	}
+	// write to a temp file first so a crash never leaves a truncated blob behind
+	tmp, err := ioutil.TempFile(c.dir, hash+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	return hash, os.Rename(tmp.Name(), p)
+}
+
+// get loads previously stored content by hash
+func (c *contentStore) get(hash string) (*siteContent, error) {
+	if _, err := hex.DecodeString(hash); err != nil {
+		return nil, fmt.Errorf("invalid content hash %q", hash)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(c.dir, hash+".json"))
+	if err != nil {
+		return nil, err
+	}
+	var content siteContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+// objects returns every file to upload to the bucket keyed by its path.
+// content from the JSON API becomes the index document.
+func (c *siteContent) objects(indexDocument string) map[string][]byte {
+	if len(c.Files) > 0 {
+		return c.Files
+	}
+	return map[string][]byte{indexDocument: []byte(c.Index)}
+}
+
+// errUpload marks problems with what the caller sent, as opposed to problems on our end
+type errUpload struct {
+	msg string
+}
+
+func (e *errUpload) Error() string {
+	return e.msg
+}
+
+func uploadErrorf(format string, args ...interface{}) error {
+	return &errUpload{msg: fmt.Sprintf(format, args...)}
+}
+
+// readSiteRequest parses the body of a create, update, or preview request. JSON bodies are decoded
+// as a CreateSiteReq. multipart forms carry the same fields as form values alongside the files,
+// while gzipped tarballs carry them as query parameters. JSON bodies are validated against schema first.
+func readSiteRequest(w http.ResponseWriter, req *http.Request, schema *jsonSchema) (*CreateSiteReq, *siteContent, error) {
+	mediaType, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		// treat bodies without a content type as JSON, as we always have
+		mediaType = "application/json"
+	}
+
+	// leave some headroom over the file limit for form fields and archive headers
+	body := http.MaxBytesReader(w, req.Body, maxUploadBytes+(1<<20))
+	switch mediaType {
+	case "multipart/form-data":
+		siteReq, content, err := readMultipartUpload(multipart.NewReader(body, params["boundary"]))
+		if err != nil {
+			return nil, nil, err
+		}
+		return siteReq, content, validateUpload(schema, siteReq)
+	case "application/gzip", "application/x-gzip", "application/x-tar+gzip":
+		siteReq, content, err := readTarballUpload(req, body)
+		if err != nil {
+			return nil, nil, err
+		}
+		return siteReq, content, validateUpload(schema, siteReq)
+	default:
+		var siteReq CreateSiteReq
+		if err := decodeJSON(body, schema, &siteReq); err != nil {
+			return nil, nil, err
+		}
+		return &siteReq, &siteContent{Index: siteReq.Content}, nil
+	}
+}
+
+// validateUpload holds the fields sent with an upload to the same schema as a JSON body, so
+// that they're checked the same way whichever way the site's content is sent
+func validateUpload(schema *jsonSchema, siteReq *CreateSiteReq) error {
+	if len(siteReq.Args) > 0 && !json.Valid(siteReq.Args) {
+		return &schemaError{Problems: []string{"$.args: invalid JSON"}}
+	}
+	data, err := json.Marshal(siteReq)
+	if err != nil {
+		return err
+	}
+	return schema.validateJSON(data)
+}
+
+// isEmpty reports whether there's nothing to serve
+func (c *siteContent) isEmpty() bool {
+	return c.Index == "" && len(c.Files) == 0
+}
+
+func readMultipartUpload(mr *multipart.Reader) (*CreateSiteReq, *siteContent, error) {
+	var siteReq CreateSiteReq
+	files := newUploadedFiles()
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, uploadErrorf("failed to read multipart form: %v", err)
+		}
+
+		// part.FileName() drops directories, so read the raw filename to keep the site's layout
+		_, params, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if filename := params["filename"]; filename != "" {
+			if err := files.add(filename, part); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		value, err := ioutil.ReadAll(io.LimitReader(part, 1<<20))
+		if err != nil {
+			return nil, nil, uploadErrorf("failed to read form field %q: %v", part.FormName(), err)
+		}
+		switch part.FormName() {
+		case "id":
+			siteReq.ID = string(value)
+		case "template":
+			siteReq.Template = string(value)
+		case "args":
+			siteReq.Args = json.RawMessage(value)
+		case "webhook":
+			siteReq.Webhooks = append(siteReq.Webhooks, string(value))
+		case "ttl":
+			siteReq.TTL = string(value)
+		case "region":
+			siteReq.Region = string(value)
+		case "domain":
+			siteReq.Domain = string(value)
+		case "provider":
+			if err := addProviderConfig(&siteReq, string(value)); err != nil {
+				return nil, nil, err
+			}
+		case "tag":
+			if err := addTag(&siteReq, string(value)); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if len(files.files) == 0 {
+		return nil, nil, uploadErrorf("multipart upload must include at least one file")
+	}
+	return &siteReq, &siteContent{Files: files.files}, nil
+}
+
+func readTarballUpload(req *http.Request, body io.Reader) (*CreateSiteReq, *siteContent, error) {
+	query := req.URL.Query()
+	siteReq := &CreateSiteReq{
+		ID:       query.Get("id"),
+		Template: query.Get("template"),
+		TTL:      query.Get("ttl"),
+		Region:   query.Get("region"),
+		Domain:   query.Get("domain"),
+	}
+	if args := query.Get("args"); args != "" {
+		siteReq.Args = json.RawMessage(args)
+	}
+	if hooks, ok := query["webhook"]; ok {
+		siteReq.Webhooks = hooks
+	}
+	for _, kv := range query["provider"] {
+		if err := addProviderConfig(siteReq, kv); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, tag := range query["tag"] {
+		if err := addTag(siteReq, tag); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, nil, uploadErrorf("failed to read gzip body: %v", err)
+	}
+	defer gz.Close()
+
+	files := newUploadedFiles()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, uploadErrorf("failed to read tarball: %v", err)
+		}
+		// directories are implied by file paths, and links and devices have no place in a website
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := files.add(hdr.Name, tr); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(files.files) == 0 {
+		return nil, nil, uploadErrorf("tarball must include at least one file")
+	}
+	return siteReq, &siteContent{Files: files.files}, nil
+}
+
+// uploadedFiles accumulates files while enforcing the upload limits. the total is counted
+// after decompression so a small tarball can't expand past the limit.
+type uploadedFiles struct {
+	files map[string][]byte
+	total int64
+}
+
+func newUploadedFiles() *uploadedFiles {
+	return &uploadedFiles{files: make(map[string][]byte)}
+}
+
+func (u *uploadedFiles) add(name string, r io.Reader) error {
+	key, err := cleanUploadPath(name)
+	if err != nil {
+		return err
+	}
+	if _, exists := u.files[key]; exists {
+		return uploadErrorf("file %q was uploaded more than once", key)
+	}
+	if len(u.files) >= maxUploadFiles {
+		return uploadErrorf("too many files, at most %d can be uploaded", maxUploadFiles)
+	}
+
+	remaining := maxUploadBytes - u.total
+	data, err := ioutil.ReadAll(io.LimitReader(r, remaining+1))
+	if err != nil {
+		return uploadErrorf("failed to read %q: %v", key, err)
+	}
+	if int64(len(data)) > remaining {
+		return uploadErrorf("upload is too large, at most %d bytes can be uploaded", maxUploadBytes)
+	}
+	u.total += int64(len(data))
+	u.files[key] = data
+	return nil
+}
+
+// cleanUploadPath turns an uploaded file name into an object key, rejecting anything
+// that tries to climb out of the site's root
+func cleanUploadPath(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", uploadErrorf("invalid file path %q", name)
+		}
+	}
+	key := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if key == "" || key == "." {
+		return "", uploadErrorf("invalid file path %q", name)
+	}
+	return key, nil
+}
+
+// contentTypeFor picks the MIME type for an object from its extension
+func contentTypeFor(key string) string {
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// sortedKeys returns the paths of the files in a stable order
+func sortedKeys(files map[string][]byte) []string {
+	keys := make([]string, 0, len(files))
+	for k := range files {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi-aws/sdk/v4/go/aws"
+	"github.com/pulumi/pulumi-aws/sdk/v4/go/aws/acm"
+	"github.com/pulumi/pulumi-aws/sdk/v4/go/aws/cloudfront"
+	"github.com/pulumi/pulumi-aws/sdk/v4/go/aws/route53"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// config keys that record a site's custom domain and the hosted zone it lives in
+const (
+	domainConfigKey     = "domain"
+	domainZoneConfigKey = "domainZone"
+)
+
+// the status reported for a custom domain until its certificate has been validated
+const certificatePendingValidation = "PENDING_VALIDATION"
+
+// domainZones are the Route53 hosted zones that custom domains can be created in, configured with
+// -domain-zones. custom domains are turned off when there are none.
+var domainZones = map[string]bool{}
+
+var validDomain = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+
+// customDomain is a domain that a site is served from over https, along with the hosted zone
+// its DNS records are created in
+type customDomain struct {
+	Name string
+	Zone string
+}
+
+// newCustomDomain checks that a domain sent with a create request falls within one of the allowed
+// hosted zones, picking the most specific zone if several match
+func newCustomDomain(raw string) (*customDomain, error) {
+	name := strings.TrimSuffix(strings.ToLower(raw), ".")
+	if len(name) > 253 || !validDomain.MatchString(name) {
+		return nil, fmt.Errorf("invalid domain %q", raw)
+	}
+	if len(domainZones) == 0 {
+		return nil, fmt.Errorf("custom domains are not enabled on this server")
+	}
+	zone := ""
+	for z := range domainZones {
+		if (name == z || strings.HasSuffix(name, "."+z)) && len(z) > len(zone) {
+			zone = z
+		}
+	}
+	if zone == "" {
+		return nil, fmt.Errorf("domain %q must be within one of %s", raw, strings.Join(sortedDomainZones(), ", "))
+	}
+	return &customDomain{Name: name, Zone: zone}, nil
+}
+
+// domainFrom reads the custom domain recorded in a stack's config, returning nil if the site doesn't have one
+func domainFrom(cfg auto.ConfigMap) *customDomain {
+	name, ok := cfg[project+":"+domainConfigKey]
+	if !ok || name.Value == "" {
+		return nil
+	}
+	return &customDomain{Name: name.Value, Zone: cfg[project+":"+domainZoneConfigKey].Value}
+}
+
+func sortedDomainZones() []string {
+	zones := make([]string, 0, len(domainZones))
+	for z := range domainZones {
+		zones = append(zones, z)
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// domainCertificate is the ACM certificate for a site's custom domain
+type domainCertificate struct {
+	// validatedArn is only known once the certificate has been issued
+	validatedArn pulumi.StringOutput
+	// status is the certificate's status as ACM reported it when the certificate was created
+	// or the site was last refreshed
+	status pulumi.StringOutput
+}
+
+// newDomainCertificate requests an ACM certificate for the domain and validates it with a DNS
+// record in the domain's hosted zone. CloudFront only accepts certificates from us-east-1, whatever
+// region the rest of the site is in.
+func newDomainCertificate(ctx *pulumi.Context, domain *customDomain, zoneID string) (*domainCertificate, error) {
+	usEast1, err := aws.NewProvider(ctx, "us-east-1", &aws.ProviderArgs{
+		Region: pulumi.String("us-east-1"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	cert, err := acm.NewCertificate(ctx, "certificate", &acm.CertificateArgs{
+		DomainName:       pulumi.String(domain.Name),
+		ValidationMethod: pulumi.String("DNS"),
+	}, pulumi.Provider(usEast1))
+	if err != nil {
+		return nil, err
+	}
+
+	option := cert.DomainValidationOptions.Index(pulumi.Int(0))
+	record, err := route53.NewRecord(ctx, "certificate-validation", &route53.RecordArgs{
+		ZoneId:  pulumi.String(zoneID),
+		Name:    option.ResourceRecordName().Elem(),
+		Type:    option.ResourceRecordType().Elem(),
+		Records: pulumi.StringArray{option.ResourceRecordValue().Elem()},
+		Ttl:     pulumi.Int(60),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// this waits for ACM to see the record and issue the certificate
+	validation, err := acm.NewCertificateValidation(ctx, "certificate-validation", &acm.CertificateValidationArgs{
+		CertificateArn:        cert.Arn,
+		ValidationRecordFqdns: pulumi.StringArray{record.Fqdn},
+	}, pulumi.Provider(usEast1))
+	if err != nil {
+		return nil, err
+	}
+	return &domainCertificate{validatedArn: validation.CertificateArn, status: cert.Status}, nil
+}
+
+// addCustomDomain serves the distribution from the domain, pointing the domain at it and
+// exporting the domain along with the status of its certificate
+func addCustomDomain(ctx *pulumi.Context, domain *customDomain, zoneID string, cdn *cloudfront.Distribution, cert *domainCertificate) error {
+	_, err := route53.NewRecord(ctx, "domain", &route53.RecordArgs{
+		ZoneId: pulumi.String(zoneID),
+		Name:   pulumi.String(domain.Name),
+		Type:   pulumi.String("A"),
+		Aliases: route53.RecordAliasArray{
+			&route53.RecordAliasArgs{
+				Name:                 cdn.DomainName,
+				ZoneId:               cdn.HostedZoneId,
+				EvaluateTargetHealth: pulumi.Bool(false),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx.Export("domain", pulumi.String(domain.Name))
+	ctx.Export("certificateStatus", cert.status)
+	return nil
+}
+
+// lookupZoneID finds the ID of the hosted zone a custom domain lives in
+func lookupZoneID(ctx *pulumi.Context, domain *customDomain) (string, error) {
+	zone, err := route53.LookupZone(ctx, &route53.LookupZoneArgs{Name: &domain.Zone})
+	if err != nil {
+		return "", fmt.Errorf("failed to find the hosted zone %q: %w", domain.Zone, err)
+	}
+	return zone.ZoneId, nil
+}
+
+// domainStatus reports a site's custom domain and the status of its certificate, falling back to
+// the domain recorded in config while the site's first deployment hasn't finished
+func domainStatus(cfg auto.ConfigMap, outs auto.OutputMap) (string, string) {
+	if name, ok := outs["domain"].Value.(string); ok {
+		status, _ := outs["certificateStatus"].Value.(string)
+		return name, status
+	}
+	if domain := domainFrom(cfg); domain != nil {
+		return domain.Name, certificatePendingValidation
+	}
+	return "", ""
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// domainMocks stands in for AWS, recording the resources a program registers and filling in the
+// outputs the custom domain resources depend on
+type domainMocks struct {
+	mu        sync.Mutex
+	resources map[string]pulumi.MockResourceArgs
+}
+
+func newDomainMocks() *domainMocks {
+	return &domainMocks{resources: make(map[string]pulumi.MockResourceArgs)}
+}
+
+func (m *domainMocks) NewResource(args pulumi.MockResourceArgs) (string, resource.PropertyMap, error) {
+	m.mu.Lock()
+	m.resources[args.TypeToken+"::"+args.Name] = args
+	m.mu.Unlock()
+
+	outs := args.Inputs.Copy()
+	switch args.TypeToken {
+	case "aws:s3/bucket:Bucket":
+		outs["websiteEndpoint"] = resource.NewStringProperty(args.Name + ".s3-website-us-west-2.amazonaws.com")
+	case "aws:acm/certificate:Certificate":
+		outs["arn"] = resource.NewStringProperty("arn:aws:acm:us-east-1:123456789012:certificate/test")
+		outs["status"] = resource.NewStringProperty(certificatePendingValidation)
+		outs["domainValidationOptions"] = resource.NewArrayProperty([]resource.PropertyValue{
+			resource.NewObjectProperty(resource.NewPropertyMapFromMap(map[string]interface{}{
+				"domainName":          args.Inputs["domainName"].StringValue(),
+				"resourceRecordName":  "_validate." + args.Inputs["domainName"].StringValue() + ".",
+				"resourceRecordType":  "CNAME",
+				"resourceRecordValue": "_token.acm-validations.aws.",
+			})),
+		})
+	case "aws:cloudfront/distribution:Distribution":
+		outs["arn"] = resource.NewStringProperty("arn:aws:cloudfront::123456789012:distribution/TEST")
+		outs["domainName"] = resource.NewStringProperty("d111111abcdef8.cloudfront.net")
+		outs["hostedZoneId"] = resource.NewStringProperty("Z2FDTNDATAQYW2")
+	case "aws:route53/record:Record":
+		outs["fqdn"] = args.Inputs["name"]
+	}
+	return args.Name + "-id", outs, nil
+}
+
+func (m *domainMocks) Call(args pulumi.MockCallArgs) (resource.PropertyMap, error) {
+	if args.Token == "aws:route53/getZone:getZone" {
+		return resource.NewPropertyMapFromMap(map[string]interface{}{
+			"name":   args.Args["name"].StringValue(),
+			"zoneId": "ZONE123",
+		}), nil
+	}
+	return args.Args, nil
+}
+
+// inputs returns the inputs a resource was registered with, failing if it wasn't
+func (m *domainMocks) inputs(t *testing.T, typ, name string) map[string]interface{} {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	args, ok := m.resources[typ+"::"+name]
+	if !ok {
+		t.Fatalf("expected a %s named %q", typ, name)
+	}
+	return args.Inputs.Mappable()
+}
+
+func (m *domainMocks) has(typ, name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.resources[typ+"::"+name]
+	return ok
+}
+
+// runTemplate runs a template's program against mocks
+func runTemplate(t *testing.T, template, args string, domain *customDomain) *domainMocks {
+	t.Helper()
+	program, err := templates[template].newProgram(json.RawMessage(args), &siteContent{Index: "<h1>hi</h1>"}, domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mocks := newDomainMocks()
+	if err := pulumi.RunErr(program, pulumi.WithMocks(project, "test", mocks)); err != nil {
+		t.Fatal(err)
+	}
+	return mocks
+}
+
+func TestCustomDomainResources(t *testing.T) {
+	for _, template := range []string{"static-site", "static-site-with-cdn"} {
+		t.Run(template, func(t *testing.T) {
+			domain := &customDomain{Name: "www.example.com", Zone: "example.com"}
+			mocks := runTemplate(t, template, "", domain)
+
+			// CloudFront only accepts certificates from us-east-1
+			provider := mocks.inputs(t, "pulumi:providers:aws", "us-east-1")
+			if provider["region"] != "us-east-1" {
+				t.Fatalf("expected the certificate's provider to be in us-east-1, got %v", provider["region"])
+			}
+			cert := mocks.inputs(t, "aws:acm/certificate:Certificate", "certificate")
+			if cert["domainName"] != domain.Name || cert["validationMethod"] != "DNS" {
+				t.Fatalf("unexpected certificate %v", cert)
+			}
+			if p := mocks.resources["aws:acm/certificate:Certificate::certificate"].Provider; !strings.Contains(p, "::us-east-1::") {
+				t.Fatalf("expected the certificate to use the us-east-1 provider, got %q", p)
+			}
+
+			validation := mocks.inputs(t, "aws:route53/record:Record", "certificate-validation")
+			if validation["zoneId"] != "ZONE123" || validation["name"] != "_validate.www.example.com." || validation["type"] != "CNAME" {
+				t.Fatalf("unexpected validation record %v", validation)
+			}
+			mocks.inputs(t, "aws:acm/certificateValidation:CertificateValidation", "certificate-validation")
+
+			cdn := mocks.inputs(t, "aws:cloudfront/distribution:Distribution", "cdn")
+			aliases, _ := cdn["aliases"].([]interface{})
+			if len(aliases) != 1 || aliases[0] != domain.Name {
+				t.Fatalf("expected the distribution to be served from %s, got %v", domain.Name, cdn["aliases"])
+			}
+			viewerCert, _ := cdn["viewerCertificate"].(map[string]interface{})
+			if viewerCert["acmCertificateArn"] != "arn:aws:acm:us-east-1:123456789012:certificate/test" || viewerCert["sslSupportMethod"] != "sni-only" {
+				t.Fatalf("expected the distribution to use the certificate, got %v", viewerCert)
+			}
+
+			record := mocks.inputs(t, "aws:route53/record:Record", "domain")
+			recordAliases, _ := record["aliases"].([]interface{})
+			if record["name"] != domain.Name || record["type"] != "A" || len(recordAliases) != 1 {
+				t.Fatalf("unexpected domain record %v", record)
+			}
+			if alias := recordAliases[0].(map[string]interface{}); alias["name"] != "d111111abcdef8.cloudfront.net" || alias["zoneId"] != "Z2FDTNDATAQYW2" {
+				t.Fatalf("expected the domain to point at the distribution, got %v", alias)
+			}
+		})
+	}
+
+	// the mocks can't see exports, so check the status that's exported comes from ACM, which
+	// the mocks report as still pending
+	status := make(chan string, 1)
+	err := pulumi.RunErr(func(ctx *pulumi.Context) error {
+		cert, err := newDomainCertificate(ctx, &customDomain{Name: "www.example.com", Zone: "example.com"}, "ZONE123")
+		if err != nil {
+			return err
+		}
+		cert.status.ApplyT(func(s string) string {
+			status <- s
+			return s
+		})
+		return nil
+	}, pulumi.WithMocks(project, "test", newDomainMocks()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-status; got != certificatePendingValidation {
+		t.Fatalf("expected the certificate's own status, got %q", got)
+	}
+}
+
+// sites with a custom domain report it and the status of its certificate
+func TestSiteWithCustomDomain(t *testing.T) {
+	defer func(zones map[string]bool) { domainZones = zones }(domainZones)
+	domainZones = map[string]bool{"example.com": true}
+	const id = "custom-domain"
+	path := "/sites/" + id
+
+	op := accepted(t, request(t, "POST", "/sites", CreateSiteReq{ID: id, Content: "<h1>hi</h1>", Template: "static-site-with-cdn", Domain: "WWW.example.com"}))
+	defer func() { accepted(t, request(t, "DELETE", path, nil)) }()
+	if op.Site == nil || op.Site.Domain != "www.example.com" || op.Site.CertificateStatus != certificatePendingValidation {
+		t.Fatalf("expected the created site to report its domain, got %+v", op.Site)
+	}
+
+	var site SiteResponse
+	expect(t, request(t, "GET", path, nil), 200, &site)
+	if site.Domain != "www.example.com" || site.CertificateStatus != certificatePendingValidation {
+		t.Fatalf("expected the site to report its domain and certificate status, got %+v", site)
+	}
+	// the domain is fixed once the site is created
+	expectError(t, request(t, "PUT", path, map[string]interface{}{"content": "hi", "domain": "api.example.com"}), 400, codeBadRequest)
+}
+
+func TestNoCustomDomain(t *testing.T) {
+	mocks := runTemplate(t, "static-site", "", nil)
+	mocks.inputs(t, "aws:s3/bucket:Bucket", "s3-website-bucket")
+	if mocks.has("aws:cloudfront/distribution:Distribution", "cdn") || mocks.has("aws:acm/certificate:Certificate", "certificate") {
+		t.Fatal("expected a static site without a custom domain to be served straight from its bucket")
+	}
+
+	mocks = runTemplate(t, "static-site-with-cdn", "", nil)
+	cdn := mocks.inputs(t, "aws:cloudfront/distribution:Distribution", "cdn")
+	if _, ok := cdn["aliases"]; ok {
+		t.Fatalf("expected a distribution without a custom domain to have no aliases, got %v", cdn["aliases"])
+	}
+}
+
+func TestRedirectRejectsCustomDomain(t *testing.T) {
+	_, err := templates["redirect-only"].newProgram(json.RawMessage(`{"hostName":"example.com"}`), &siteContent{}, &customDomain{Name: "www.example.com", Zone: "example.com"})
+	if err == nil {
+		t.Fatal("expected the redirect-only template to reject a custom domain")
+	}
+}
+
+func TestNewCustomDomain(t *testing.T) {
+	defer func(zones map[string]bool) { domainZones = zones }(domainZones)
+	domainZones = map[string]bool{}
+	if _, err := newCustomDomain("www.example.com"); err == nil {
+		t.Fatal("expected custom domains to be off without any hosted zones")
+	}
+
+	domainZones = map[string]bool{"example.com": true, "docs.example.com": true}
+	tests := []struct {
+		raw  string
+		zone string
+	}{
+		{"example.com", "example.com"},
+		{"WWW.Example.com.", "example.com"},
+		{"api.docs.example.com", "docs.example.com"},
+		{"example.org", ""},
+		{"badexample.com", ""},
+		{"not a domain", ""},
+	}
+	for _, tt := range tests {
+		domain, err := newCustomDomain(tt.raw)
+		if tt.zone == "" {
+			if err == nil {
+				t.Errorf("expected %q to be rejected, got %+v", tt.raw, domain)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expected %q to be accepted: %v", tt.raw, err)
+			continue
+		}
+		if domain.Zone != tt.zone {
+			t.Errorf("expected %q to be in zone %q, got %q", tt.raw, tt.zone, domain.Zone)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optrefresh"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// driftTracker remembers the result of the most recent drift check for each site
+type driftTracker struct {
+	mu       sync.Mutex
+	statuses map[string]*DriftStatus
+}
+
+var driftStatuses = &driftTracker{statuses: make(map[string]*DriftStatus)}
+
+func (d *driftTracker) record(stackName string, status *DriftStatus) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.statuses[stackName] = status
+}
+
+func (d *driftTracker) get(stackName string) *DriftStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.statuses[stackName]
+}
+
+func (d *driftTracker) forget(stackName string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.statuses, stackName)
+}
+
+// refreshes a site's state from the cloud provider, adopting any out of band changes
+func refreshHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx := context.Background()
+	params := mux.Vars(req)
+	siteID := params["id"]
+	stackName := stackNameFor(req, siteID)
+	// refresh doesn't run the program, it only reads the resources in the state
+	var program pulumi.RunFunc = nil
+
+	s, err := siteStacks.selectStack(ctx, stackName, program)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	hooks, err := siteWebhooks(ctx, s)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+
+	op, err := operations.enqueue("refresh", callerFrom(req).Tenant, siteID, hooks, func(ctx context.Context, op *operation) (*SiteResponse, error) {
+		if err := ensureRegion(ctx, s); err != nil {
+			return nil, err
+		}
+		refreshRes, err := s.Refresh(ctx, optrefresh.ProgressStreams(os.Stdout), optrefresh.EventStreams(op.eventStream()))
+		if err != nil {
+			if auto.IsConcurrentUpdateError(err) {
+				updateConflicts.inc(op.kind)
+			}
+			return nil, err
+		}
+		recordResourceChanges(op.kind, refreshRes.Summary)
+		// the state now matches what's actually deployed
+		driftStatuses.record(stackName, &DriftStatus{CheckedAt: time.Now()})
+
+		outs, err := s.Outputs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		op.setOutputs(outs)
+		return siteFromOutputs(siteID, outs), nil
+	})
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	writeAccepted(w, op)
+}
+
+// the suffix of the scratch stack a site's drift checks refresh. stacks are named after a site
+// ID, after the tenant and a dot if there is one, and neither can contain a dot, so the scratch
+// stack never clashes with a site's.
+const driftStackSuffix = "..drift"
+
+func isDriftStack(stackName string) bool {
+	return strings.HasSuffix(stackName, driftStackSuffix)
+}
+
+// reports whether the resources for a site have been changed outside of Pulumi, by running a
+// refresh that doesn't change the site. like a preview, it returns its result directly, so
+// rather than wait behind the site's operations it fails with a 409 while any are queued or
+// running.
+func driftHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx := context.Background()
+	params := mux.Vars(req)
+	siteID := params["id"]
+	stackName := stackNameFor(req, siteID)
+
+	s, err := siteStacks.selectStack(ctx, stackName, nil)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	release, err := tryLockStack(req.Context(), stackName)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	defer release()
+
+	status, err := checkDrift(req.Context(), s)
+	if err != nil {
+		if auto.IsConcurrentUpdateError(err) {
+			updateConflicts.inc("drift")
+		}
+		driftStatuses.record(stackName, &DriftStatus{
+			CheckedAt: time.Now(),
+			Error:     err.Error(),
+		})
+		writeError(w, siteID, err)
+		return
+	}
+	driftStatuses.record(stackName, status)
+
+	response := &DriftResponse{
+		ID:          siteID,
+		DriftStatus: *status,
+	}
+	json.NewEncoder(w).Encode(&response)
+}
+
+// enqueueDriftCheck queues a background drift check of a site, recording its result for
+// GET /sites/{id}. the check doesn't change the site, so it doesn't notify the site's webhooks.
+func enqueueDriftCheck(tenant, siteID, stackName string) (*operation, error) {
+	return operations.enqueue("drift", tenant, siteID, nil, func(ctx context.Context, op *operation) (*SiteResponse, error) {
+		s, err := siteStacks.selectStack(ctx, stackName, nil)
+		if err != nil {
+			return nil, err
+		}
+		status, err := checkDrift(ctx, s, op.eventStream())
+		if err != nil {
+			if auto.IsConcurrentUpdateError(err) {
+				updateConflicts.inc(op.kind)
+			}
+			driftStatuses.record(stackName, &DriftStatus{
+				CheckedAt: time.Now(),
+				Error:     err.Error(),
+			})
+			return nil, err
+		}
+		driftStatuses.record(stackName, status)
+
+		outs, err := s.Outputs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		site := siteFromOutputs(siteID, outs)
+		site.Drift = status
+		return site, nil
+	})
+}
+
+// checkDrift runs a refresh to find resources that no longer match the site's state.
+//
+// the Automation API doesn't offer a preview-only refresh, and refreshing the site's own stack
+// would record an update in its history and change its ETag. so the refresh runs against a
+// scratch stack holding a copy of the site's state and config, which is removed afterwards.
+func checkDrift(ctx context.Context, s siteStack, streams ...chan<- events.EngineEvent) (*DriftStatus, error) {
+	if err := ensureRegion(ctx, s); err != nil {
+		return nil, err
+	}
+	stackName := s.Name()
+	state, err := s.Export(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := s.GetAllConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the scratch stack only lives as long as the check
+	delete(cfg, project+":"+expiresAtConfigKey)
+
+	scratchName := stackName + driftStackSuffix
+	scratch, err := scratchStack(ctx, scratchName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stack for drift check: %w", err)
+	}
+	defer removeScratchStack(scratch, state)
+	if err := scratch.SetAllConfig(ctx, cfg); err != nil {
+		return nil, err
+	}
+	scratchState := state
+	scratchState.Deployment = renameState(state.Deployment, stackName, scratchName)
+	if err := scratch.Import(ctx, scratchState); err != nil {
+		return nil, err
+	}
+
+	evts := make(chan events.EngineEvent)
+	drifted := collectDrift(evts)
+	stream, finish := teeEvents(evts)
+	_, err = scratch.Refresh(ctx, optrefresh.EventStreams(append(streams, stream)...))
+	recorded := finish()
+	if err != nil {
+		return nil, withDiagnostics(err, recorded)
+	}
+
+	resources := <-drifted
+	return &DriftStatus{
+		Drifted:   len(resources) > 0,
+		CheckedAt: time.Now(),
+		Resources: resources,
+	}, nil
+}
+
+// scratchStack creates the scratch stack for a drift check. a check that was cut short can
+// leave its scratch stack behind, in which case it's reused.
+func scratchStack(ctx context.Context, scratchName string) (siteStack, error) {
+	if s, err := siteStacks.selectStack(ctx, scratchName, nil); err == nil {
+		return s, nil
+	}
+	return siteStacks.newStack(ctx, scratchName, nil)
+}
+
+// removeScratchStack removes a drift check's scratch stack. its resources are dropped from its
+// state first, since they're the site's and a stack with resources can't be removed.
+func removeScratchStack(scratch siteStack, state apitype.UntypedDeployment) {
+	ctx := context.Background()
+	var d map[string]json.RawMessage
+	err := json.Unmarshal(state.Deployment, &d)
+	if err == nil {
+		d["resources"] = json.RawMessage("[]")
+		delete(d, "pending_operations")
+		state.Deployment, err = json.Marshal(d)
+	}
+	if err == nil {
+		err = scratch.Import(ctx, state)
+	}
+	if err == nil {
+		err = siteStacks.removeStack(ctx, scratch.Name())
+	}
+	if err != nil {
+		fmt.Printf("drift check: failed to remove stack %q: %v\n", scratch.Name(), err)
+	}
+}
+
+// collectDrift reads refresh events until the channel is closed and sends back
+// every resource whose outputs changed or that no longer exists
+func collectDrift(evts <-chan events.EngineEvent) <-chan []ResourceChange {
+	out := make(chan []ResourceChange, 1)
+	go func() {
+		changes := []ResourceChange{}
+		for e := range evts {
+			if e.ResOutputsEvent == nil {
+				continue
+			}
+			md := e.ResOutputsEvent.Metadata
+			if md.Type == "pulumi:pulumi:Stack" {
+				continue
+			}
+			if change, ok := driftedResource(md); ok {
+				changes = append(changes, change)
+			}
+		}
+		out <- changes
+	}()
+	return out
+}
+
+// driftedResource compares the before and after state of a refresh step
+func driftedResource(md apitype.StepEventMetadata) (ResourceChange, bool) {
+	change := ResourceChange{URN: md.URN, Type: md.Type}
+	switch {
+	case md.New == nil:
+		change.Op = "delete"
+		return change, true
+	case md.Old == nil:
+		return change, false
+	}
+
+	for k, v := range md.New.Outputs {
+		if !reflect.DeepEqual(md.Old.Outputs[k], v) {
+			change.Diffs = append(change.Diffs, k)
+		}
+	}
+	for k := range md.Old.Outputs {
+		if _, ok := md.New.Outputs[k]; !ok {
+			change.Diffs = append(change.Diffs, k)
+		}
+	}
+	if len(change.Diffs) == 0 {
+		return change, false
+	}
+	sort.Strings(change.Diffs)
+	change.Op = "update"
+	return change, true
+}
+
+// runDriftScheduler checks every site for drift on the given interval, forever
+func runDriftScheduler(interval time.Duration) {
+	for range time.Tick(interval) {
+		checkAllSites()
+	}
+}
+
+// the drift checks queued by the scheduler, so that a slow check isn't queued again behind itself
+var scheduledChecks = newOpTracker()
+
+func checkAllSites() {
+	ctx := context.Background()
+	stacks, err := siteStacks.listStacks(ctx)
+	if err != nil {
+		fmt.Printf("drift scheduler: failed to list stacks: %v\n", err)
+		return
+	}
+	for _, stack := range stacks {
+		// don't fight with deployments that are already underway
+		if stack.UpdateInProgress || isDriftStack(stack.Name) || scheduledChecks.busy(stack.Name) {
+			continue
+		}
+		tenant, siteID := splitStackName(stack.Name)
+		op, err := enqueueDriftCheck(tenant, siteID, stack.Name)
+		if err != nil {
+			fmt.Printf("drift scheduler: failed to check stack %q: %v\n", stack.Name, err)
+			driftStatuses.record(stack.Name, &DriftStatus{
+				CheckedAt: time.Now(),
+				Error:     err.Error(),
+			})
+			continue
+		}
+		scheduledChecks.track(stack.Name, op)
+	}
+}
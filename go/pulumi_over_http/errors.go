@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/diag/colors"
+)
+
+// error codes returned in ErrorResponse.Code
+const (
+	codeBadRequest         = "bad_request"
+	codeUnauthorized       = "unauthorized"
+	codeForbidden          = "forbidden"
+	codeNotFound           = "not_found"
+	codeConflict           = "conflict"
+	codePreconditionFailed = "precondition_failed"
+	codeInvalidProgram     = "invalid_program"
+	codeUnprocessable      = "unprocessable"
+	codeQueueFull          = "queue_full"
+	codeShuttingDown       = "shutting_down"
+	codeInternal           = "internal"
+)
+
+// apiError is an error along with the status and code to report it with
+type apiError struct {
+	status int
+	code   string
+	err    error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func (e *apiError) Unwrap() error {
+	return e.err
+}
+
+func newAPIError(status int, code, format string, args ...interface{}) error {
+	return &apiError{status: status, code: code, err: fmt.Errorf(format, args...)}
+}
+
+// badRequest marks err as a problem with what the caller sent
+func badRequest(err error) error {
+	return &apiError{status: 400, code: codeBadRequest, err: err}
+}
+
+// diagnosticsError carries the engine diagnostics from a failed update alongside its error
+type diagnosticsError struct {
+	err         error
+	diagnostics []string
+}
+
+func (e *diagnosticsError) Error() string {
+	return e.err.Error()
+}
+
+func (e *diagnosticsError) Unwrap() error {
+	return e.err
+}
+
+// withDiagnostics attaches the error diagnostics reported in the events to err
+func withDiagnostics(err error, evts []apitype.EngineEvent) error {
+	var diagnostics []string
+	for _, e := range evts {
+		if e.DiagnosticEvent == nil || e.DiagnosticEvent.Severity != "error" {
+			continue
+		}
+		msg := colors.Never.Colorize(e.DiagnosticEvent.Prefix + e.DiagnosticEvent.Message)
+		diagnostics = append(diagnostics, strings.TrimSpace(msg))
+	}
+	if err == nil || len(diagnostics) == 0 {
+		return err
+	}
+	return &diagnosticsError{err: err, diagnostics: diagnostics}
+}
+
+// errorResponse maps an error to the status and body to report it with. Automation API errors
+// are recognized here so that every handler reports them the same way.
+func errorResponse(err error, siteID string) (int, *ErrorResponse) {
+	res := &ErrorResponse{Stack: siteID}
+	var diagErr *diagnosticsError
+	if errors.As(err, &diagErr) {
+		res.Details = diagErr.diagnostics
+		err = diagErr.err
+	}
+
+	// schema errors list every problem with the request, which is more useful than a single message
+	var schemaErr *schemaError
+	if errors.As(err, &schemaErr) {
+		res.Details = schemaErr.Problems
+	}
+
+	var apiErr *apiError
+	var uploadErr *errUpload
+	status := 500
+	res.Code = codeInternal
+	res.Message = err.Error()
+	switch {
+	case errors.As(err, &apiErr):
+		status, res.Code = apiErr.status, apiErr.code
+	case errors.As(err, &uploadErr), errors.As(err, &schemaErr):
+		status, res.Code = 400, codeBadRequest
+	case errors.Is(err, errQueueFull):
+		status, res.Code = 503, codeQueueFull
+	case errors.Is(err, errShuttingDown):
+		status, res.Code = 503, codeShuttingDown
+	case auto.IsSelectStack404Error(err):
+		status, res.Code = 404, codeNotFound
+		res.Message = fmt.Sprintf("stack %q not found", siteID)
+	case auto.IsCreateStack409Error(err):
+		status, res.Code = 409, codeConflict
+		res.Message = fmt.Sprintf("stack %q already exists", siteID)
+	case auto.IsConcurrentUpdateError(err):
+		status, res.Code = 409, codeConflict
+		res.Message = fmt.Sprintf("stack %q already has update in progress", siteID)
+	case auto.IsCompilationError(err):
+		status, res.Code = 422, codeInvalidProgram
+		res.Message = fmt.Sprintf("the program for stack %q failed to compile", siteID)
+	case auto.IsRuntimeError(err):
+		status, res.Code = 422, codeInvalidProgram
+		res.Message = fmt.Sprintf("the program for stack %q failed at runtime", siteID)
+	}
+	return status, res
+}
+
+// writeError responds with the JSON error body for err
+func writeError(w http.ResponseWriter, siteID string, err error) {
+	status, res := errorResponse(err, siteID)
+	writeErrorResponse(w, status, res)
+}
+
+// writeErrorf responds with an error we raise ourselves
+func writeErrorf(w http.ResponseWriter, status int, code, siteID, format string, args ...interface{}) {
+	writeError(w, siteID, newAPIError(status, code, format, args...))
+}
+
+func writeErrorResponse(w http.ResponseWriter, status int, res *ErrorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// teeEvents forwards engine events to out while keeping a copy of them, so that the diagnostics
+// can be reported if the command fails. call finish once the command has returned: it closes out
+// and returns the events. the Automation API only closes the returned channel if the command got
+// as far as running the CLI, so finish doesn't wait for it to.
+func teeEvents(out chan<- events.EngineEvent) (chan<- events.EngineEvent, func() []apitype.EngineEvent) {
+	in := make(chan events.EngineEvent)
+	done := make(chan struct{})
+	recorded := make(chan []apitype.EngineEvent, 1)
+	go func() {
+		var evts []apitype.EngineEvent
+		defer func() {
+			close(out)
+			recorded <- evts
+		}()
+		for {
+			select {
+			case e, ok := <-in:
+				if !ok {
+					return
+				}
+				if e.Error == nil {
+					evts = append(evts, e.EngineEvent)
+				}
+				out <- e
+			case <-done:
+				return
+			}
+		}
+	}()
+	finish := func() []apitype.EngineEvent {
+		close(done)
+		return <-recorded
+	}
+	return in, finish
+}
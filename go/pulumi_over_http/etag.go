@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// siteVersion returns the version of the stack's most recent update, or 0 if it has none.
+// every up, refresh, and destroy bumps the version, so it changes whenever the site does.
+func siteVersion(ctx context.Context, s siteStack) (int, error) {
+	history, err := s.History(ctx, 1, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(history) == 0 {
+		return 0, nil
+	}
+	return history[0].Version, nil
+}
+
+func siteETag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// ifMatches reports whether an If-Match header is satisfied by the given version
+func ifMatches(header string, version int) bool {
+	etag := siteETag(version)
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		// our ETags are strong, but be lenient about clients that send them back as weak
+		candidate = strings.TrimPrefix(candidate, "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch enforces the request's If-Match header against the stack's current version,
+// writing a 412 and returning false if it doesn't match. the version is returned so that the
+// operation can check it again right before it runs. it's -1 when there was no If-Match header.
+func checkIfMatch(ctx context.Context, w http.ResponseWriter, req *http.Request, s siteStack, siteID string) (int, bool) {
+	header := req.Header.Get("If-Match")
+	if header == "" {
+		return -1, true
+	}
+	version, err := siteVersion(ctx, s)
+	if err != nil {
+		writeError(w, siteID, err)
+		return 0, false
+	}
+	if !ifMatches(header, version) {
+		w.Header().Set("ETag", siteETag(version))
+		writeErrorf(w, 412, codePreconditionFailed, siteID, "site %q has changed, its current ETag is %s", siteID, siteETag(version))
+		return 0, false
+	}
+	return version, true
+}
+
+// ensureVersion fails if the stack has been updated since the If-Match check was made.
+// operations can sit in the queue for a while, so the check is repeated before they run.
+func ensureVersion(ctx context.Context, s siteStack, siteID string, expected int) error {
+	if expected < 0 {
+		return nil
+	}
+	version, err := siteVersion(ctx, s)
+	if err != nil {
+		return err
+	}
+	if version != expected {
+		return newAPIError(412, codePreconditionFailed, "stack %q changed from version %d to %d while the operation was queued", siteID, expected, version)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// how often to write an SSE comment to keep idle connections from being closed by proxies
+const sseKeepAliveInterval = 15 * time.Second
+
+// streams the engine events for an operation to the client as Server-Sent Events.
+// each event's SSE id is its position in the operation's log, so clients can reconnect
+// with a Last-Event-ID header (or ?after=N) and pick up where they left off.
+func operationEventsHandler(w http.ResponseWriter, req *http.Request) {
+	params := mux.Vars(req)
+	siteID := params["id"]
+	opID := params["op"]
+
+	op, ok := operations.get(callerFrom(req).Tenant, opID)
+	if !ok || op.siteID != siteID {
+		writeErrorf(w, 404, codeNotFound, siteID, "operation %q not found for site %q", opID, siteID)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErrorf(w, 500, codeInternal, siteID, "streaming is not supported by this connection")
+		return
+	}
+
+	after, err := lastEventID(req)
+	if err != nil {
+		writeErrorf(w, 400, codeBadRequest, siteID, "invalid event sequence number: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		evts, changed, done := op.eventsSince(after)
+		for _, e := range evts {
+			after++
+			data, err := json.Marshal(e)
+			if err != nil {
+				fmt.Printf("operation %s: failed to marshal engine event: %v\n", op.id, err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: engineEvent\ndata: %s\n\n", after, data)
+		}
+
+		// once the operation has finished and we've sent everything, close out the stream
+		// with the final state of the operation
+		if done && len(evts) == 0 {
+			data, _ := json.Marshal(op.response())
+			fmt.Fprintf(w, "event: done\ndata: %s\n\n", data)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			fmt.Fprintf(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// lastEventID determines how many events the client has already seen,
+// preferring the standard Last-Event-ID header sent by EventSource on reconnect
+func lastEventID(req *http.Request) (int, error) {
+	raw := req.Header.Get("Last-Event-ID")
+	if raw == "" {
+		raw = req.URL.Query().Get("after")
+	}
+	if raw == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%d is negative", n)
+	}
+	return n, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
+)
+
+// expiresAtConfigKey holds the time a site expires, if it was given a TTL. it's kept out of
+// siteSettings so that updates and rollbacks leave it alone.
+const expiresAtConfigKey = "expiresAt"
+
+// parseTTL parses the ttl of a create or patch request
+func parseTTL(raw string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl %q, must be a duration such as 72h", raw)
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("invalid ttl %q, must be positive", raw)
+	}
+	return ttl, nil
+}
+
+// setExpiry records when a site expires, or removes its expiry if expiresAt is nil
+func setExpiry(ctx context.Context, s siteStack, expiresAt *time.Time) error {
+	if expiresAt == nil {
+		return s.RemoveConfig(ctx, expiresAtConfigKey)
+	}
+	return s.SetConfig(ctx, expiresAtConfigKey, auto.ConfigValue{Value: expiresAt.UTC().Format(time.RFC3339)})
+}
+
+// expiryFrom reads the expiry from a stack's config, returning nil if the site doesn't expire
+func expiryFrom(cfg auto.ConfigMap) (*time.Time, error) {
+	val, ok := cfg[project+":"+expiresAtConfigKey]
+	if !ok {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, val.Value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode expiry: %w", err)
+	}
+	return &t, nil
+}
+
+// changes the TTL of a site without redeploying it. the new expiry counts from now.
+func patchHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := context.Background()
+	params := mux.Vars(req)
+	siteID := params["id"]
+	stackName := stackNameFor(req, siteID)
+
+	var patchReq PatchSiteReq
+	if err := decodeJSON(req.Body, patchSiteSchema, &patchReq); err != nil {
+		writeErrorf(w, 400, codeBadRequest, siteID, "failed to parse patch request: %w", err)
+		return
+	}
+	var expiresAt *time.Time
+	if *patchReq.TTL != "" {
+		ttl, err := parseTTL(*patchReq.TTL)
+		if err != nil {
+			writeError(w, siteID, badRequest(err))
+			return
+		}
+		t := time.Now().Add(ttl)
+		expiresAt = &t
+	}
+
+	s, err := siteStacks.selectStack(ctx, stackName, nil)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	// turn stale requests away without waiting, then check again once it's our turn
+	if _, ok := checkIfMatch(ctx, w, req, s, siteID); !ok {
+		return
+	}
+	// the expiry lives in the stack's config, so wait for the site's queued operations rather
+	// than change the config out from under one of them
+	ticket, err := stackLocks.lock(req.Context(), stackName)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	defer ticket.release()
+	if _, ok := checkIfMatch(ctx, w, req, s, siteID); !ok {
+		return
+	}
+	if err := setExpiry(ctx, s, expiresAt); err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	writeSite(ctx, w, 200, s, siteID, stackName)
+}
+
+// runReaper destroys expired sites every interval
+func runReaper(interval time.Duration) {
+	for range time.Tick(interval) {
+		reapExpiredSites()
+	}
+}
+
+// the operations started by the reaper, so that a site isn't reaped twice while the first is still running
+var reaping = newOpTracker()
+
+func reapExpiredSites() {
+	ctx := context.Background()
+	stacks, err := siteStacks.listStacks(ctx)
+	if err != nil {
+		fmt.Printf("reaper: failed to list stacks: %v\n", err)
+		return
+	}
+	now := time.Now()
+	for _, stack := range stacks {
+		if stack.UpdateInProgress || isDriftStack(stack.Name) || reaping.busy(stack.Name) {
+			continue
+		}
+		// the expiry is in the stack's own config, which only its workspace can read
+		s, err := siteStacks.selectStack(ctx, stack.Name, nil)
+		if err != nil {
+			fmt.Printf("reaper: failed to select stack %q: %v\n", stack.Name, err)
+			continue
+		}
+		cfg, err := s.GetAllConfig(ctx)
+		if err != nil {
+			fmt.Printf("reaper: failed to read config of stack %q: %v\n", stack.Name, err)
+			continue
+		}
+		expiresAt, err := expiryFrom(cfg)
+		if err != nil {
+			fmt.Printf("reaper: stack %q: %v\n", stack.Name, err)
+			continue
+		}
+		if expiresAt == nil || now.Before(*expiresAt) {
+			continue
+		}
+		if err := reapSite(ctx, s); err != nil {
+			fmt.Printf("reaper: failed to expire stack %q: %v\n", stack.Name, err)
+		}
+	}
+}
+
+// reapSite enqueues an operation that destroys an expired site and removes its stack
+func reapSite(ctx context.Context, s siteStack) error {
+	stackName := s.Name()
+	tenant, siteID := splitStackName(stackName)
+	hooks, err := siteWebhooks(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("reaper: stack %q has expired, destroying it\n", stackName)
+	op, err := operations.enqueue("expire", tenant, siteID, hooks, func(ctx context.Context, op *operation) (*SiteResponse, error) {
+		if err := ensureRegion(ctx, s); err != nil {
+			return nil, err
+		}
+		destroyRes, err := s.Destroy(ctx, optdestroy.ProgressStreams(os.Stdout), optdestroy.EventStreams(op.eventStream()))
+		if err != nil {
+			return nil, err
+		}
+		recordResourceChanges(op.kind, destroyRes.Summary)
+		driftStatuses.forget(stackName)
+		return nil, siteStacks.removeStack(ctx, stackName)
+	})
+	if err != nil {
+		return err
+	}
+	reaping.track(stackName, op)
+	return nil
+}
@@ -3,7 +3,10 @@ module github.com/pulumi/automation-api-examples/go/pulumi_over_http
 go 1.14
 
 require (
-	github.com/gorilla/mux v1.8.0 // indirect
+	github.com/golang-jwt/jwt v3.2.2+incompatible
+	github.com/gorilla/mux v1.8.0
 	github.com/pulumi/pulumi-aws/sdk/v4 v4.0.0
 	github.com/pulumi/pulumi/sdk/v3 v3.0.0
+	github.com/spf13/cobra v1.0.0
+	go.etcd.io/bbolt v1.3.5
 )
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+)
+
+// requiredPlugins are installed when the server starts, and /readyz checks that they still are
+var requiredPlugins = []requiredPlugin{
+	{name: "aws", version: "v3.2.1"},
+}
+
+type requiredPlugin struct {
+	name    string
+	version string
+}
+
+// how long a round of readiness checks may take before the checks still running are failed
+const readinessTimeout = time.Minute
+
+// readiness check and overall statuses
+const (
+	checkOK      = "ok"
+	checkFailed  = "failed"
+	checkSkipped = "skipped"
+
+	statusReady    = "ready"
+	statusNotReady = "not_ready"
+	statusStarting = "starting"
+	statusDraining = "draining"
+)
+
+// readinessChecker keeps the result of the latest readiness checks. the checks run the Pulumi
+// CLI, which can take longer than a probe is willing to wait, so they run in the background
+// and /readyz reports the latest result.
+type readinessChecker struct {
+	mu     sync.Mutex
+	latest *ReadinessResponse
+}
+
+var readiness = &readinessChecker{}
+
+// runReadinessChecks checks the toolchain every interval
+func runReadinessChecks(interval time.Duration) {
+	readiness.check()
+	for range time.Tick(interval) {
+		readiness.check()
+	}
+}
+
+// check makes sure the Pulumi CLI runs, the backend can be reached, and the required plugins
+// are installed, recording the result of each
+func (r *readinessChecker) check() *ReadinessResponse {
+	ctx, cancel := context.WithTimeout(context.Background(), readinessTimeout)
+	defer cancel()
+
+	var checks []ReadinessCheck
+	run := func(name string, fn func() (string, error)) bool {
+		start := time.Now()
+		msg, err := fn()
+		c := ReadinessCheck{Name: name, Status: checkOK, Message: msg, DurationSeconds: time.Since(start).Seconds()}
+		if err != nil {
+			c.Status, c.Message = checkFailed, err.Error()
+		}
+		checks = append(checks, c)
+		return err == nil
+	}
+
+	// creating a workspace runs `pulumi version`, so it's the check that the CLI works at all
+	var ws auto.Workspace
+	cliOK := run("cli", func() (string, error) {
+		var err error
+		if ws, err = siteStacks.workspace(ctx); err != nil {
+			return "", err
+		}
+		return "pulumi v" + ws.PulumiVersion(), nil
+	})
+	if cliOK {
+		run("backend", func() (string, error) {
+			user, err := ws.WhoAmI(ctx)
+			if err != nil {
+				return "", err
+			}
+			return "logged in as " + user, nil
+		})
+		run("plugins", func() (string, error) {
+			return checkPlugins(ctx, ws)
+		})
+	} else {
+		for _, name := range []string{"backend", "plugins"} {
+			checks = append(checks, ReadinessCheck{Name: name, Status: checkSkipped, Message: "the pulumi CLI isn't usable"})
+		}
+	}
+
+	now := time.Now()
+	res := &ReadinessResponse{Status: statusReady, CheckedAt: &now, Checks: checks}
+	for _, c := range checks {
+		passed := 0.0
+		if c.Status == checkOK {
+			passed = 1
+		} else {
+			res.Status = statusNotReady
+		}
+		readinessChecks.set(passed, c.Name)
+	}
+
+	r.mu.Lock()
+	r.latest = res
+	r.mu.Unlock()
+	return res
+}
+
+// checkPlugins makes sure every required plugin is installed at the version we need
+func checkPlugins(ctx context.Context, ws auto.Workspace) (string, error) {
+	plugins, err := ws.ListPlugins(ctx)
+	if err != nil {
+		return "", err
+	}
+	var found, missing []string
+	for _, required := range requiredPlugins {
+		ok := false
+		for _, p := range plugins {
+			if p.Kind == workspace.ResourcePlugin && p.Name == required.name && p.Version != nil &&
+				"v"+p.Version.String() == required.version {
+				ok = true
+				break
+			}
+		}
+		if ok {
+			found = append(found, required.name+" "+required.version)
+		} else {
+			missing = append(missing, required.name+" "+required.version)
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing plugins: %s", strings.Join(missing, ", "))
+	}
+	return strings.Join(found, ", "), nil
+}
+
+// get returns the latest result, or nil if the first checks haven't finished yet
+func (r *readinessChecker) get() *ReadinessResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.latest
+}
+
+// reports that the process is up. it doesn't look at anything else, so that a problem with the
+// Pulumi toolchain takes the server out of rotation rather than having it restarted.
+func healthzHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&HealthResponse{Status: "ok"})
+}
+
+// reports whether the server can run operations, with the result of each readiness check.
+// it's a 503 until the first checks pass, whenever one fails, and once the server is draining.
+func readyzHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	res := readiness.get()
+	if res == nil {
+		res = &ReadinessResponse{Status: statusStarting, Checks: []ReadinessCheck{}}
+	}
+	if operations.isDraining() {
+		draining := *res
+		draining.Status = statusDraining
+		res = &draining
+	}
+	if res.Status != statusReady {
+		w.WriteHeader(503)
+	}
+	json.NewEncoder(w).Encode(res)
+}
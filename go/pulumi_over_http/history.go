@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// lists the updates that have been made to a site
+func historyHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(req)
+	siteID := params["id"]
+	stackName := stackNameFor(req, siteID)
+
+	// pagination is optional, by default we return the full history
+	pageSize, err := queryInt(req, "pageSize")
+	if err != nil {
+		writeErrorf(w, 400, codeBadRequest, siteID, "invalid pageSize: %v", err)
+		return
+	}
+	page, err := queryInt(req, "page")
+	if err != nil {
+		writeErrorf(w, 400, codeBadRequest, siteID, "invalid page: %v", err)
+		return
+	}
+
+	// we don't need a program since we're just reading the history
+	var program pulumi.RunFunc = nil
+	ctx := context.Background()
+	s, err := siteStacks.selectStack(ctx, stackName, program)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+
+	history, err := s.History(ctx, pageSize, page)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+
+	updates := []HistoryEntry{}
+	for _, h := range history {
+		entry := HistoryEntry{
+			Version:   h.Version,
+			Kind:      h.Kind,
+			Result:    h.Result,
+			StartTime: h.StartTime,
+			EndTime:   h.EndTime,
+		}
+		if h.ResourceChanges != nil {
+			entry.ResourceChanges = *h.ResourceChanges
+		}
+		entry.HasContent = hasRecordedContent(h.Config)
+		updates = append(updates, entry)
+	}
+
+	response := &SiteHistoryResponse{
+		ID:      siteID,
+		Updates: updates,
+	}
+	json.NewEncoder(w).Encode(&response)
+}
+
+// redeploys the content that a site had at a previous version
+func rollbackHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(req)
+	siteID := params["id"]
+	stackName := stackNameFor(req, siteID)
+
+	version, err := queryInt(req, "version")
+	if err != nil || version < 1 {
+		writeErrorf(w, 400, codeBadRequest, siteID, "a positive version query parameter is required")
+		return
+	}
+
+	ctx := context.Background()
+	// the program is set once we know which settings to roll back to
+	s, err := siteStacks.selectStack(ctx, stackName, nil)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+
+	history, err := s.History(ctx, 0, 0)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	var target *auto.UpdateSummary
+	for i := range history {
+		if history[i].Version == version {
+			target = &history[i]
+			break
+		}
+	}
+	if target == nil {
+		writeErrorf(w, 404, codeNotFound, siteID, "version %d not found for stack %q", version, siteID)
+		return
+	}
+	settings, err := siteSettingsFrom(target.Config)
+	if err != nil {
+		writeErrorf(w, 422, codeUnprocessable, siteID, "version %d of stack %q can't be rolled back to: %v", version, siteID, err)
+		return
+	}
+	program, err := settings.program()
+	if err != nil {
+		writeErrorf(w, 422, codeUnprocessable, siteID, "version %d of stack %q can't be redeployed: %w", version, siteID, err)
+		return
+	}
+
+	// rolling back the site shouldn't change who gets notified about it, or how it's tagged
+	hooks, err := latestWebhooks(history)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+
+	op, err := operations.enqueue("rollback", callerFrom(req).Tenant, siteID, hooks, func(ctx context.Context, op *operation) (*SiteResponse, error) {
+		// the webhooks and tags are read again now that it's this operation's turn, so that an
+		// update queued ahead of it isn't undone, and the settings are only saved now so that
+		// they can't leak into that update
+		history, err := s.History(ctx, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		if settings.Webhooks, err = latestWebhooks(history); err != nil {
+			return nil, err
+		}
+		if settings.Tags, err = latestTags(history); err != nil {
+			return nil, err
+		}
+		siteStacks.setProgram(s, program)
+		if err := ensureRegion(ctx, s); err != nil {
+			return nil, err
+		}
+		if err := settings.save(ctx, s); err != nil {
+			return nil, err
+		}
+		upRes, err := s.Up(ctx,
+			optup.Message(fmt.Sprintf("rollback to version %d", version)),
+			optup.ProgressStreams(os.Stdout),
+			optup.EventStreams(op.eventStream()),
+		)
+		if err != nil {
+			if auto.IsConcurrentUpdateError(err) {
+				updateConflicts.inc(op.kind)
+			}
+			return nil, err
+		}
+		op.setOutputs(upRes.Outputs)
+		recordResourceChanges(op.kind, upRes.Summary)
+		return siteFromOutputs(siteID, upRes.Outputs), nil
+	})
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	writeAccepted(w, op)
+}
+
+// queryInt parses an optional integer query parameter, returning 0 if it's not set
+func queryInt(req *http.Request, name string) (int, error) {
+	raw := req.URL.Query().Get(name)
+	if raw == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(raw)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyStore remembers the responses to requests sent with an Idempotency-Key header,
+// so that a client retrying a create or update gets the original result back instead of
+// a 409 or a second deployment
+type idempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*idempotentResponse
+}
+
+// idempotentResponse is a response recorded for a key. done is closed once the first
+// request has finished, so retries that arrive while it's still running can wait for it.
+type idempotentResponse struct {
+	method  string
+	path    string
+	done    chan struct{}
+	expires time.Time
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyKeys holds the recorded responses, set up in main
+var idempotencyKeys *idempotencyStore
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		ttl:     ttl,
+		entries: make(map[string]*idempotentResponse),
+	}
+}
+
+// begin returns the entry for a key, and whether the caller is the first to use it and so
+// is responsible for handling the request and calling finish or abandon
+func (s *idempotencyStore) begin(key, method, path string) (*idempotentResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range s.entries {
+		if isDone(e) && now.After(e.expires) {
+			delete(s.entries, k)
+		}
+	}
+
+	if e, ok := s.entries[key]; ok {
+		return e, false
+	}
+	e := &idempotentResponse{
+		method: method,
+		path:   path,
+		done:   make(chan struct{}),
+	}
+	s.entries[key] = e
+	return e, true
+}
+
+// finish records the response to replay for the rest of the window
+func (s *idempotencyStore) finish(e *idempotentResponse, status int, header http.Header, body []byte) {
+	s.mu.Lock()
+	e.status = status
+	e.header = header
+	e.body = body
+	e.expires = time.Now().Add(s.ttl)
+	s.mu.Unlock()
+	close(e.done)
+}
+
+// abandon forgets a key whose request failed on our end, so that a retry runs it again
+func (s *idempotencyStore) abandon(key string, e *idempotentResponse) {
+	s.mu.Lock()
+	if s.entries[key] == e {
+		delete(s.entries, key)
+	}
+	s.mu.Unlock()
+	close(e.done)
+}
+
+func isDone(e *idempotentResponse) bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// idempotent wraps a handler so that requests with an Idempotency-Key header are only handled
+// once per key. keys are scoped to the caller's tenant, and a key can't be reused for a
+// different method or path.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, req)
+			return
+		}
+		if len(key) > 255 {
+			writeErrorf(w, 400, codeBadRequest, "", "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		storeKey := callerFrom(req).Tenant + "\x00" + key
+		e, first := idempotencyKeys.begin(storeKey, req.Method, req.URL.Path)
+		if !first {
+			<-e.done
+			if e.method != req.Method || e.path != req.URL.Path {
+				writeErrorf(w, 422, codeUnprocessable, "", "Idempotency-Key %q was already used for %s %s", key, e.method, e.path)
+				return
+			}
+			if e.header == nil {
+				// the first request failed on our end and was abandoned, so handle this one afresh
+				idempotent(next)(w, req)
+				return
+			}
+			for k, v := range e.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(e.status)
+			w.Write(e.body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: 200}
+		defer func() {
+			// server errors such as a full queue are worth retrying, so don't hold on to them
+			if rec.status >= 500 {
+				idempotencyKeys.abandon(storeKey, e)
+				return
+			}
+			idempotencyKeys.finish(e, rec.status, w.Header().Clone(), rec.body.Bytes())
+		}()
+		next(rec, req)
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+// the most sites returned in a single page of GET /sites
+const (
+	defaultSitesPageSize = 100
+	maxSitesPageSize     = 1000
+)
+
+// limits on the tags a site can carry
+const (
+	maxSiteTags      = 20
+	maxTagValueBytes = 256
+)
+
+var validTagKey = regexp.MustCompile(`^[A-Za-z0-9_.:/-]{1,64}$`)
+
+// validateTags checks the tags sent with a create or update request
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxSiteTags {
+		return fmt.Errorf("at most %d tags can be set on a site", maxSiteTags)
+	}
+	for k, v := range tags {
+		if !validTagKey.MatchString(k) {
+			return fmt.Errorf("invalid tag %q, keys must be 1-64 letters, digits, or any of _.:/-", k)
+		}
+		if len(v) > maxTagValueBytes {
+			return fmt.Errorf("the value of tag %q is longer than %d bytes", k, maxTagValueBytes)
+		}
+	}
+	return nil
+}
+
+// addTag adds a tag sent as key=value in a form field or query parameter
+func addTag(siteReq *CreateSiteReq, raw string) error {
+	kv := strings.SplitN(raw, "=", 2)
+	if len(kv) != 2 {
+		return uploadErrorf("invalid tag %q, must be key=value", raw)
+	}
+	if siteReq.Tags == nil {
+		siteReq.Tags = make(map[string]string)
+	}
+	siteReq.Tags[kv[0]] = kv[1]
+	return nil
+}
+
+// siteFilter selects the sites to list. tags are only looked up for sites that pass
+// every other filter, since reading a stack's config takes a call to the Pulumi CLI.
+type siteFilter struct {
+	prefix        string
+	tags          map[string]string
+	updatedSince  time.Time
+	updatedBefore time.Time
+}
+
+func siteFilterFrom(req *http.Request) (*siteFilter, error) {
+	query := req.URL.Query()
+	f := &siteFilter{prefix: query.Get("prefix")}
+	for _, tag := range query["tag"] {
+		// a tag without a value matches any site with that tag
+		kv := strings.SplitN(tag, "=", 2)
+		if f.tags == nil {
+			f.tags = make(map[string]string)
+		}
+		if len(kv) == 2 {
+			f.tags[kv[0]] = kv[1]
+		} else {
+			f.tags[kv[0]] = ""
+		}
+	}
+	var err error
+	if f.updatedSince, err = queryTime(req, "updatedSince"); err != nil {
+		return nil, err
+	}
+	if f.updatedBefore, err = queryTime(req, "updatedBefore"); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// matchesSummary applies the filters that only need the stack's summary
+func (f *siteFilter) matchesSummary(id string, stack auto.StackSummary) bool {
+	if !strings.HasPrefix(id, f.prefix) {
+		return false
+	}
+	if f.updatedSince.IsZero() && f.updatedBefore.IsZero() {
+		return true
+	}
+	// stacks that have never been updated have no last update to compare
+	lastUpdate, err := time.Parse(time.RFC3339, stack.LastUpdate)
+	if err != nil {
+		return false
+	}
+	if !f.updatedSince.IsZero() && lastUpdate.Before(f.updatedSince) {
+		return false
+	}
+	if !f.updatedBefore.IsZero() && !lastUpdate.Before(f.updatedBefore) {
+		return false
+	}
+	return true
+}
+
+// matchesTags looks up the stack's tags if the filter needs them. they're in the stack's own
+// config, so the stack has to be selected to read them.
+func (f *siteFilter) matchesTags(ctx context.Context, stackName string) (bool, error) {
+	if len(f.tags) == 0 {
+		return true, nil
+	}
+	s, err := siteStacks.selectStack(ctx, stackName, nil)
+	if err != nil {
+		return false, err
+	}
+	cfg, err := s.GetAllConfig(ctx)
+	if err != nil {
+		return false, err
+	}
+	tags, err := tagsFrom(cfg)
+	if err != nil {
+		return false, err
+	}
+	for k, want := range f.tags {
+		got, ok := tags[k]
+		if !ok || (want != "" && got != want) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// listSites returns a page of the tenant's sites that match the filter, ordered by ID and
+// starting after the cursor, along with the cursor for the next page
+func listSites(ctx context.Context, tenant string, f *siteFilter, cursor string, limit int) ([]SiteSummary, string, error) {
+	stacks, err := siteStacks.listStacks(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var candidates []SiteSummary
+	names := make(map[string]string)
+	for _, stack := range stacks {
+		id, ok := siteIDFor(tenant, stack.Name)
+		if !ok || id <= cursor || !f.matchesSummary(id, stack) {
+			continue
+		}
+		names[id] = stack.Name
+		candidates = append(candidates, SiteSummary{
+			ID:               id,
+			LastUpdate:       stack.LastUpdate,
+			UpdateInProgress: stack.UpdateInProgress,
+			ResourceCount:    stack.ResourceCount,
+			URL:              stack.URL,
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].ID < candidates[j].ID })
+
+	sites := []SiteSummary{}
+	for _, site := range candidates {
+		ok, err := f.matchesTags(ctx, names[site.ID])
+		if err != nil {
+			return nil, "", err
+		}
+		if !ok {
+			continue
+		}
+		if len(sites) == limit {
+			return sites, sites[len(sites)-1].ID, nil
+		}
+		sites = append(sites, site)
+	}
+	return sites, "", nil
+}
+
+// queryTime parses an optional RFC 3339 query parameter, returning the zero time if it's not set
+func queryTime(req *http.Request, name string) (time.Time, error) {
+	raw := req.URL.Query().Get(name)
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+	}
+	return t, nil
+}
+
+// pageLimit parses the limit query parameter, falling back to def when it's not set
+func pageLimit(req *http.Request, def, max int) (int, error) {
+	raw := req.URL.Query().Get("limit")
+	if raw == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 || n > max {
+		return 0, fmt.Errorf("limit must be between 1 and %d", max)
+	}
+	return n, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// stackLocks lets one deployment at a time run against each stack, in the order they were
+// requested, rather than having them trip over the backend's update lock
+var stackLocks = newKeyedMutex()
+
+// deploymentSlots caps how many deployments, previews, and drift checks run at once across
+// every stack, set with -workers. each one starts a pulumi process of its own.
+var deploymentSlots = newSemaphore(4)
+
+// keyedMutex is a mutex per key that hands the lock to waiters in the order they queued for it
+type keyedMutex struct {
+	mu     sync.Mutex
+	queues map[string][]*lockTicket
+}
+
+// lockTicket is a place in line for a key's lock. ready is closed once it's at the front.
+type lockTicket struct {
+	m     *keyedMutex
+	key   string
+	ready chan struct{}
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{queues: make(map[string][]*lockTicket)}
+}
+
+// queue joins the line for the key's lock without waiting for it
+func (m *keyedMutex) queue(key string) *lockTicket {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := &lockTicket{m: m, key: key, ready: make(chan struct{})}
+	m.queues[key] = append(m.queues[key], t)
+	if len(m.queues[key]) == 1 {
+		close(t.ready)
+	}
+	return t
+}
+
+// lock waits for the key's lock, giving up its place in line if ctx is done first
+func (m *keyedMutex) lock(ctx context.Context, key string) (*lockTicket, error) {
+	t := m.queue(key)
+	select {
+	case <-t.ready:
+		return t, nil
+	case <-ctx.Done():
+		t.release()
+		return nil, ctx.Err()
+	}
+}
+
+// tryLock takes the key's lock only if nobody holds it or is waiting for it
+func (m *keyedMutex) tryLock(key string) (*lockTicket, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.queues[key]) > 0 {
+		return nil, false
+	}
+	t := &lockTicket{m: m, key: key, ready: make(chan struct{})}
+	close(t.ready)
+	m.queues[key] = []*lockTicket{t}
+	return t, true
+}
+
+// ahead returns how many tickets are in line in front of t
+func (t *lockTicket) ahead() int {
+	t.m.mu.Lock()
+	defer t.m.mu.Unlock()
+	for i, other := range t.m.queues[t.key] {
+		if other == t {
+			return i
+		}
+	}
+	return 0
+}
+
+// release gives up the ticket, handing the lock to the next in line if t held it
+func (t *lockTicket) release() {
+	m := t.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.queues[t.key]
+	for i, other := range q {
+		if other != t {
+			continue
+		}
+		q = append(q[:i:i], q[i+1:]...)
+		if i == 0 && len(q) > 0 {
+			close(q[0].ready)
+		}
+		break
+	}
+	if len(q) == 0 {
+		delete(m.queues, t.key)
+	} else {
+		m.queues[t.key] = q
+	}
+}
+
+// semaphore limits how many holders there are at once
+type semaphore chan struct{}
+
+func newSemaphore(n int) semaphore {
+	if n < 1 {
+		n = 1
+	}
+	return make(semaphore, n)
+}
+
+// acquire waits for a free slot until ctx is done
+func (s semaphore) acquire(ctx context.Context) error {
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s semaphore) release() {
+	<-s
+}
+
+// tryLockStack takes the stack's turn, failing with a 409 error if operations are queued or
+// running on it, then waits for a free deployment slot. it's for work that runs the engine
+// outside of the operation queue on behalf of a caller who's waiting for the result. the
+// returned function gives both back.
+func tryLockStack(ctx context.Context, stackName string) (func(), error) {
+	t, ok := stackLocks.tryLock(stackName)
+	if !ok {
+		return nil, newAPIError(409, codeConflict, "stack %q has operations queued or running, try again once they're done", stackName)
+	}
+	if err := deploymentSlots.acquire(ctx); err != nil {
+		t.release()
+		return nil, err
+	}
+	return func() {
+		deploymentSlots.release()
+		t.release()
+	}, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyedMutexOrder(t *testing.T) {
+	m := newKeyedMutex()
+	first := m.queue("a")
+	second := m.queue("a")
+	third := m.queue("a")
+	other := m.queue("b")
+
+	for _, ready := range []*lockTicket{first, other} {
+		select {
+		case <-ready.ready:
+		default:
+			t.Fatal("expected the first ticket for each key to hold the lock")
+		}
+	}
+	if n := third.ahead(); n != 2 {
+		t.Fatalf("expected 2 tickets ahead of the third, got %d", n)
+	}
+
+	// leaving the line early doesn't hand over the lock
+	second.release()
+	select {
+	case <-third.ready:
+		t.Fatal("expected the third ticket to wait for the first")
+	default:
+	}
+	first.release()
+	select {
+	case <-third.ready:
+	case <-time.After(time.Second):
+		t.Fatal("expected the third ticket to get the lock once the first was released")
+	}
+	third.release()
+	other.release()
+	if len(m.queues) != 0 {
+		t.Fatalf("expected every line to be cleaned up, got %v", m.queues)
+	}
+}
+
+func TestKeyedMutexCancel(t *testing.T) {
+	m := newKeyedMutex()
+	held := m.queue("a")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := m.lock(ctx, "a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the lock to time out, got %v", err)
+	}
+	held.release()
+	if _, err := m.lock(context.Background(), "a"); err != nil {
+		t.Fatalf("expected the lock to be free, got %v", err)
+	}
+}
+
+// operations on the same site run one at a time in the order they were enqueued, and report
+// where they are in the queue while they wait
+func TestOperationQueueSerializesSites(t *testing.T) {
+	q := newOperationQueue(3, time.Hour)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	run := func(name string) runFunc {
+		return func(ctx context.Context, op *operation) (*SiteResponse, error) {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			<-release
+			return nil, nil
+		}
+	}
+
+	var ops []*operation
+	for _, name := range []string{"first", "second", "third"} {
+		op, err := q.enqueue("update", "serial", "site", nil, run(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ops = append(ops, op)
+	}
+	if _, err := q.enqueue("update", "serial", "site", nil, run("fourth")); !errors.Is(err, errQueueFull) {
+		t.Fatalf("expected the queue to be full, got %v", err)
+	}
+
+	waitUntil(t, func() bool { return ops[0].response().Status == OperationRunning })
+	res := ops[2].response()
+	if res.Status != OperationQueued || res.Ahead != 2 || res.QueueDepth != 2 {
+		t.Fatalf("expected the third operation to be queued behind 2 others, got %+v", res)
+	}
+
+	close(release)
+	for _, op := range ops {
+		waitUntil(t, func() bool { return op.response().FinishedAt != nil })
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 3 || order[0] != "first" || order[1] != "second" || order[2] != "third" {
+		t.Fatalf("expected the operations to run in order, got %v", order)
+	}
+}
+
+func waitUntil(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
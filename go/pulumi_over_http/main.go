@@ -3,138 +3,386 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/pulumi/pulumi-aws/sdk/v4/go/aws/s3"
+	"github.com/pulumi/automation-api-examples/go/pulumi_over_http/api"
 	"github.com/pulumi/pulumi/sdk/v3/go/auto"
 	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
 	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
-	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
-	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
 )
 
-// define request/response types for various REST ops
+// the request and response types are defined in ./api so that the Go client can share them
+type (
+	OperationStatus             = api.OperationStatus
+	CreateSiteReq               = api.CreateSiteReq
+	UpdateSiteReq               = api.UpdateSiteReq
+	PatchSiteReq                = api.PatchSiteReq
+	SiteResponse                = api.SiteResponse
+	ListSitesResponse           = api.ListSitesResponse
+	SiteSummary                 = api.SiteSummary
+	OperationResponse           = api.OperationResponse
+	WebhookPayload              = api.WebhookPayload
+	WebhookFailure              = api.WebhookFailure
+	ListWebhookFailuresResponse = api.ListWebhookFailuresResponse
+	ErrorResponse               = api.ErrorResponse
+	PendingOperation            = api.PendingOperation
+	SiteRecoveryResponse        = api.SiteRecoveryResponse
+	ListRecoveriesResponse      = api.ListRecoveriesResponse
+	AuditRecord                 = api.AuditRecord
+	ListAuditResponse           = api.ListAuditResponse
+	ResourceChange              = api.ResourceChange
+	PreviewSiteResponse         = api.PreviewSiteResponse
+	DriftStatus                 = api.DriftStatus
+	DriftResponse               = api.DriftResponse
+	HistoryEntry                = api.HistoryEntry
+	SiteHistoryResponse         = api.SiteHistoryResponse
+	TemplateResponse            = api.TemplateResponse
+	ListTemplatesResponse       = api.ListTemplatesResponse
+	SiteState                   = api.SiteState
+	CloneSiteReq                = api.CloneSiteReq
+	HealthResponse              = api.HealthResponse
+	ReadinessResponse           = api.ReadinessResponse
+	ReadinessCheck              = api.ReadinessCheck
+)
 
-type CreateSiteReq struct {
-	ID      string `json:"id"`
-	Content string `json:"content"`
-}
+var project = "pulumi_over_http"
 
-type UpdateSiteReq struct {
-	Content string `json:"content"`
-}
+// operations holds the queue of pending and completed site mutations
+var operations *operationQueue
 
-type SiteResponse struct {
-	ID  string `json:"id"`
-	URL string `json:"url"`
-}
+func main() {
+	workers := flag.Int("workers", 4, "number of deployments, previews, and drift checks to run in parallel")
+	queueDepth := flag.Int("queue-depth", 100, "maximum number of operations waiting to run")
+	operationRetention := flag.Duration("operation-retention", 24*time.Hour, "how long to keep finished operations and their events")
+	driftInterval := flag.Duration("drift-interval", 0, "how often to check every site for drift, 0 disables the check")
+	contentDir := flag.String("content-dir", "site-content", "directory to keep the content deployed to each site in")
+	stacksDir := flag.String("stacks-dir", "stacks", "directory to keep each stack's work directory, and with it the stack's config, in")
+	flag.IntVar(&maxUploadFiles, "max-upload-files", maxUploadFiles, "maximum number of files in a single upload")
+	flag.Int64Var(&maxUploadBytes, "max-upload-bytes", maxUploadBytes, "maximum total size of the files in a single upload")
+	shutdownGrace := flag.Duration("shutdown-grace", 5*time.Minute, "how long to wait for running operations when shutting down before cancelling them")
+	idempotencyWindow := flag.Duration("idempotency-window", 24*time.Hour, "how long to remember responses to requests with an Idempotency-Key header")
+	webhookURLs := flag.String("webhook-urls", "", "comma separated webhooks to notify when any operation finishes")
+	webhookSecret := flag.String("webhook-secret", os.Getenv("WEBHOOK_SECRET"), "shared secret for signing webhook notifications, defaults to $WEBHOOK_SECRET")
+	webhookAttempts := flag.Int("webhook-attempts", 5, "how many times to try delivering each webhook notification")
+	webhookAllowPrivate := flag.Bool("webhook-allow-private", false, "let sites register webhooks on loopback, link-local, and private addresses")
+	apiKeysFile := flag.String("api-keys-file", "", "JSON file of API keys to accept, see README")
+	jwtSecret := flag.String("jwt-secret", os.Getenv("JWT_SECRET"), "shared secret for verifying HMAC signed JWTs, defaults to $JWT_SECRET")
+	flag.StringVar(&defaultRegion, "default-region", defaultRegion, "AWS region for sites created without one")
+	allowedRegionsList := flag.String("allowed-regions", "us-west-2", "comma separated AWS regions that sites can be created in")
+	allowedProviderConfigList := flag.String("allowed-provider-config", "", "comma separated provider config keys, such as aws:skipMetadataApiCheck, that can be set when creating a site")
+	domainZonesList := flag.String("domain-zones", "", "comma separated Route53 hosted zones that sites can have custom domains in, empty disables custom domains")
+	reapInterval := flag.Duration("reap-interval", time.Minute, "how often to look for sites whose TTL has expired, 0 disables expiry")
+	auditDB := flag.String("audit-db", "audit.db", "file to keep the audit log of mutating requests in")
+	readyInterval := flag.Duration("ready-interval", 30*time.Second, "how often to check that the Pulumi CLI, backend, and plugins are usable for /readyz")
+	flag.Parse()
+	allowedRegions = splitList(*allowedRegionsList)
+	allowedRegions[defaultRegion] = true
+	allowedProviderConfig = splitList(*allowedProviderConfigList)
+	domainZones = splitList(strings.ToLower(*domainZonesList))
+
+	siteStacks = newLocalStackManager(*stacksDir)
+	ensurePlugins()
 
-type ListSitesResponse struct {
-	IDs []string `json:"ids"`
-}
+	var err error
+	contents, err = newContentStore(*contentDir)
+	if err != nil {
+		fmt.Printf("Failed to set up content store: %v\n", err)
+		os.Exit(1)
+	}
 
-var project = "pulumi_over_http"
+	audit, err = openAuditStore(*auditDB)
+	if err != nil {
+		fmt.Printf("Failed to open audit log: %v\n", err)
+		os.Exit(1)
+	}
+	defer audit.close()
 
-func main() {
-	ensurePlugins()
+	var globalWebhooks []string
+	if *webhookURLs != "" {
+		globalWebhooks = strings.Split(*webhookURLs, ",")
+	}
+	for _, h := range globalWebhooks {
+		if err := validateWebhookURL(h); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if len(globalWebhooks) > 0 && *webhookSecret == "" {
+		fmt.Println("-webhook-secret is required when -webhook-urls is set")
+		os.Exit(1)
+	}
+	webhooks = newWebhookDispatcher(*webhookSecret, globalWebhooks, *webhookAttempts, *webhookAllowPrivate)
+
+	deploymentSlots = newSemaphore(*workers)
+	operations = newOperationQueue(*queueDepth, *operationRetention)
+	idempotencyKeys = newIdempotencyStore(*idempotencyWindow)
+	if *driftInterval > 0 {
+		go runDriftScheduler(*driftInterval)
+	}
+	if *reapInterval > 0 {
+		go runReaper(*reapInterval)
+	}
+	// look for stacks left with pending operations by an update that was interrupted last time
+	go findPendingOperations()
+	go runReadinessChecks(*readyInterval)
+
+	// authentication is off unless API keys or a JWT secret are configured
+	var authenticators []authenticator
+	if *apiKeysFile != "" {
+		a, err := newAPIKeyAuthenticator(*apiKeysFile)
+		if err != nil {
+			fmt.Printf("Failed to load API keys: %v\n", err)
+			os.Exit(1)
+		}
+		authenticators = append(authenticators, a)
+	}
+	if *jwtSecret != "" {
+		authenticators = append(authenticators, newJWTAuthenticator(*jwtSecret))
+	}
+	if len(authenticators) == 0 {
+		fmt.Println("authentication is disabled, every request can manage every site")
+	}
+
+	handler, err := newHandler(newRouter(authenticators))
+	if err != nil {
+		fmt.Printf("Failed to describe the API: %v\n", err)
+		os.Exit(1)
+	}
+
+	// define and start our http server
+	s := &http.Server{
+		Addr:    ":1337",
+		Handler: handler,
+	}
+	fmt.Println("starting server on :1337")
+	go func() {
+		if err := s.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// on SIGTERM or SIGINT, stop taking on new work and let running deployments finish,
+	// rather than killing them part way through and leaving their stacks locked
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	<-stop
+	fmt.Printf("shutting down, waiting up to %s for running operations\n", *shutdownGrace)
+	operations.drain(*shutdownGrace)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		fmt.Printf("failed to shut down cleanly: %v\n", err)
+	}
+}
 
+// newRouter sets up the API's routes behind the given authenticators
+func newRouter(authenticators []authenticator) *mux.Router {
 	router := mux.NewRouter()
+	router.Use(metricsMiddleware)
+	router.Use(drainingMiddleware)
+	router.Use(authMiddleware(authenticators))
+	router.Use(auditMiddleware)
 
 	// setup our RESTful routes for our Site resource
-	router.HandleFunc("/sites", createHandler).Methods("POST")
+	router.HandleFunc("/sites", idempotent(createHandler)).Methods("POST")
 	router.HandleFunc("/sites", listHandler).Methods("GET")
 	router.HandleFunc("/sites/{id}", getHandler).Methods("GET")
-	router.HandleFunc("/sites/{id}", updateHandler).Methods("PUT")
+	router.HandleFunc("/sites/{id}", idempotent(updateHandler)).Methods("PUT")
+	router.HandleFunc("/sites/{id}", patchHandler).Methods("PATCH")
 	router.HandleFunc("/sites/{id}", deleteHandler).Methods("DELETE")
+	router.HandleFunc("/sites/{id}/preview", previewHandler).Methods("POST")
+	router.HandleFunc("/sites/{id}/refresh", refreshHandler).Methods("POST")
+	router.HandleFunc("/sites/{id}/drift", driftHandler).Methods("GET")
+	router.HandleFunc("/sites/{id}/history", historyHandler).Methods("GET")
+	router.HandleFunc("/sites/{id}/rollback", rollbackHandler).Methods("POST")
+	router.HandleFunc("/sites/{id}/recovery", getRecoveryHandler).Methods("GET")
+	router.HandleFunc("/sites/{id}/recover", recoverHandler).Methods("POST")
+	router.HandleFunc("/recovery", listRecoveriesHandler).Methods("GET")
+	// state is exported and imported as is, so only admins may touch it
+	router.HandleFunc("/sites/{id}/state", adminOnly(exportStateHandler)).Methods("GET")
+	router.HandleFunc("/sites/{id}/state", adminOnly(importStateHandler)).Methods("PUT")
+	router.HandleFunc("/sites/{id}/clone", adminOnly(idempotent(cloneHandler))).Methods("POST")
+
+	// mutations run asynchronously, so expose their progress as a resource too
+	router.HandleFunc("/operations/{id}", getOperationHandler).Methods("GET")
+	router.HandleFunc("/templates", listTemplatesHandler).Methods("GET")
+	router.HandleFunc("/webhooks/failures", webhookFailuresHandler).Methods("GET")
+	router.HandleFunc("/audit", auditHandler).Methods("GET")
+	router.HandleFunc("/sites/{id}/operations/{op}/events", operationEventsHandler).Methods("GET")
+	return router
+}
 
-	// define and start our http server
-	s := &http.Server{
-		Addr:    ":1337",
-		Handler: router,
+// newHandler serves the router along with the endpoints that sit outside of it
+func newHandler(router *mux.Router) (http.Handler, error) {
+	// the OpenAPI document is built from the router, so that it describes every route
+	spec, err := newOpenAPIDocument(router)
+	if err != nil {
+		return nil, err
 	}
-	fmt.Println("starting server on :1337")
-	log.Fatal(s.ListenAndServe())
+
+	// metrics, probes, and the OpenAPI document are served outside of the router so that
+	// scrapers, Kubernetes, and tooling don't need credentials
+	root := http.NewServeMux()
+	root.HandleFunc("/metrics", metricsHandler)
+	root.HandleFunc("/healthz", healthzHandler)
+	root.HandleFunc("/readyz", readyzHandler)
+	root.HandleFunc("/openapi.json", openAPIHandler(spec))
+	root.Handle("/", router)
+	return root, nil
 }
 
 // creates new sites
 func createHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	var createReq CreateSiteReq
-	err := json.NewDecoder(req.Body).Decode(&createReq)
+	// the body is either JSON, a multipart form, or a tarball of the site's files
+	createReq, content, err := readSiteRequest(w, req, createSiteSchema)
 	if err != nil {
-		w.WriteHeader(400)
-		fmt.Fprintf(w, "failed to parse create request")
+		writeErrorf(w, 400, codeBadRequest, "", "failed to parse create request: %w", err)
 		return
 	}
 
 	ctx := context.Background()
 
-	stackName := createReq.ID
-	program := createPulumiProgram(createReq.Content)
-
-	s, err := auto.NewStackInlineSource(ctx, stackName, project, program)
-	if err != nil {
-		// if stack already exists, 409
-		if auto.IsCreateStack409Error(err) {
-			w.WriteHeader(409)
-			fmt.Fprintf(w, fmt.Sprintf("stack %q already exists", stackName))
+	siteID := createReq.ID
+	// site IDs become part of the stack name, so keep them to characters that are safe there
+	if !validName.MatchString(siteID) {
+		writeErrorf(w, 400, codeBadRequest, siteID, "invalid site id %q, must be 1-64 letters, digits, dashes or underscores", siteID)
+		return
+	}
+	stackName := stackNameFor(req, siteID)
+	settings := &siteSettings{
+		Template: createReq.Template,
+		Args:     createReq.Args,
+		Content:  content,
+		Webhooks: createReq.Webhooks,
+		Tags:     createReq.Tags,
+	}
+	if err := validateWebhooks(settings.Webhooks); err != nil {
+		writeError(w, siteID, badRequest(err))
+		return
+	}
+	if err := validateTags(settings.Tags); err != nil {
+		writeError(w, siteID, badRequest(err))
+		return
+	}
+	if err := validateProviderConfig(createReq.Region, createReq.Provider); err != nil {
+		writeError(w, siteID, badRequest(err))
+		return
+	}
+	if createReq.Domain != "" {
+		if settings.Domain, err = newCustomDomain(createReq.Domain); err != nil {
+			writeError(w, siteID, badRequest(err))
 			return
 		}
-
-		w.WriteHeader(500)
-		fmt.Fprintf(w, err.Error())
+	}
+	var expiresAt *time.Time
+	if createReq.TTL != "" {
+		ttl, err := parseTTL(createReq.TTL)
+		if err != nil {
+			writeError(w, siteID, badRequest(err))
+			return
+		}
+		t := time.Now().Add(ttl)
+		expiresAt = &t
+	}
+	if settings.Template == "" {
+		settings.Template = defaultTemplate
+	}
+	if err := requireContent(settings); err != nil {
+		writeError(w, siteID, badRequest(err))
 		return
 	}
-	s.SetConfig(ctx, "aws:region", auto.ConfigValue{Value: "us-west-2"})
-
-	// deploy the stack
-	// we'll write all of the update logs to st	out so we can watch requests get processed
-	upRes, err := s.Up(ctx, optup.ProgressStreams(os.Stdout))
+	// build the program up front so that bad template arguments are rejected before creating a stack
+	program, err := settings.program()
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, err.Error())
+		writeError(w, siteID, badRequest(err))
 		return
 	}
 
-	response := &SiteResponse{
-		ID:  stackName,
-		URL: upRes.Outputs["websiteUrl"].Value.(string),
+	s, err := siteStacks.newStack(ctx, stackName, program)
+	if err != nil {
+		// if stack already exists, this is a 409
+		writeError(w, siteID, err)
+		return
 	}
-	json.NewEncoder(w).Encode(&response)
+	// deploy the stack in the background, the caller can poll the operation for the result
+	op, err := operations.enqueue("create", callerFrom(req).Tenant, siteID, settings.Webhooks, func(ctx context.Context, op *operation) (*SiteResponse, error) {
+		// the stack's config is only written once it's this operation's turn, like every other
+		// change to a stack. the region and provider config are kept there, so every later
+		// operation reuses them.
+		if err := setProviderConfig(ctx, s, createReq.Region, createReq.Provider); err != nil {
+			return nil, err
+		}
+		// record the site's settings so that we can roll back to them later
+		if err := settings.save(ctx, s); err != nil {
+			return nil, err
+		}
+		if expiresAt != nil {
+			if err := setExpiry(ctx, s, expiresAt); err != nil {
+				return nil, err
+			}
+		}
+		// we'll write all of the update logs to stdout so we can watch requests get processed
+		upRes, err := s.Up(ctx, optup.ProgressStreams(os.Stdout), optup.EventStreams(op.eventStream()))
+		if err != nil {
+			return nil, err
+		}
+		op.setOutputs(upRes.Outputs)
+		recordResourceChanges(op.kind, upRes.Summary)
+		return siteFromOutputs(siteID, upRes.Outputs), nil
+	})
+	if err != nil {
+		// don't leave an empty stack behind if we couldn't schedule the deployment
+		siteStacks.removeStack(ctx, stackName)
+		writeError(w, siteID, err)
+		return
+	}
+	writeAccepted(w, op)
 }
 
-// lists all sites
+// lists the caller's sites a page at a time, optionally filtered by ID prefix, tags, and when they
+// were last updated. ?expand=summary includes what the backend knows about each site's stack.
 func listHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	ctx := context.Background()
-	// set up a workspace with only enough information for the list stack operations
-	ws, err := auto.NewLocalWorkspace(ctx, auto.Project(workspace.Project{
-		Name:    tokens.PackageName(project),
-		Runtime: workspace.NewProjectRuntimeInfo("go", nil),
-	}))
+	filter, err := siteFilterFrom(req)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, err.Error())
+		writeError(w, "", badRequest(err))
 		return
 	}
-	stacks, err := ws.ListStacks(ctx)
+	limit, err := pageLimit(req, defaultSitesPageSize, maxSitesPageSize)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, err.Error())
+		writeError(w, "", badRequest(err))
 		return
 	}
-	var ids []string
-	for _, stack := range stacks {
-		ids = append(ids, stack.Name)
+
+	// only show the caller their own tenant's sites
+	sites, next, err := listSites(ctx, callerFrom(req).Tenant, filter, req.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		writeError(w, "", err)
+		return
 	}
 
 	response := &ListSitesResponse{
-		IDs: ids,
+		IDs:        []string{},
+		NextCursor: next,
+	}
+	for _, site := range sites {
+		response.IDs = append(response.IDs, site.ID)
+	}
+	if req.URL.Query().Get("expand") == "summary" {
+		response.Sites = sites
 	}
 	json.NewEncoder(w).Encode(&response)
 }
@@ -143,90 +391,181 @@ func listHandler(w http.ResponseWriter, req *http.Request) {
 func getHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	params := mux.Vars(req)
-	stackName := params["id"]
+	siteID := params["id"]
+	stackName := stackNameFor(req, siteID)
 	// we don't need a program since we're just getting stack outputs
 	var program pulumi.RunFunc = nil
 	ctx := context.Background()
-	s, err := auto.SelectStackInlineSource(ctx, stackName, project, program)
+	s, err := siteStacks.selectStack(ctx, stackName, program)
 	if err != nil {
-		// if the stack doesn't already exist, 404
-		if auto.IsSelectStack404Error(err) {
-			w.WriteHeader(404)
-			fmt.Fprintf(w, fmt.Sprintf("stack %q not found", stackName))
-			return
-		}
-
-		w.WriteHeader(500)
-		fmt.Fprintf(w, err.Error())
+		writeError(w, siteID, err)
 		return
 	}
+	writeSite(ctx, w, 200, s, siteID, stackName)
+}
 
+// writeSite responds with the site's outputs and settings, along with its ETag
+func writeSite(ctx context.Context, w http.ResponseWriter, status int, s siteStack, siteID, stackName string) {
 	// fetch the outputs from the stack
 	outs, err := s.Outputs(ctx)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, err.Error())
+		writeError(w, siteID, err)
+		return
+	}
+
+	version, err := siteVersion(ctx, s)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	cfg, err := s.GetAllConfig(ctx)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	tags, err := tagsFrom(cfg)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	expiresAt, err := expiryFrom(cfg)
+	if err != nil {
+		writeError(w, siteID, err)
 		return
 	}
 
+	// a site whose first deployment failed, or whose state was imported empty, has no URL yet
+	url, _ := outs["websiteUrl"].Value.(string)
 	response := &SiteResponse{
-		ID:  stackName,
-		URL: outs["websiteUrl"].Value.(string),
+		ID:        siteID,
+		URL:       url,
+		Region:    regionFrom(cfg),
+		Tags:      tags,
+		ExpiresAt: expiresAt,
+		Drift:     driftStatuses.get(stackName),
 	}
+	response.Domain, response.CertificateStatus = domainStatus(cfg, outs)
+	// clients send the ETag back in If-Match to make sure nobody changed the site in the meantime
+	w.Header().Set("ETag", siteETag(version))
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(&response)
 }
 
+// siteFromOutputs builds the site an operation reports from the stack's outputs once it's done
+func siteFromOutputs(siteID string, outs auto.OutputMap) *SiteResponse {
+	site := &SiteResponse{
+		ID: siteID,
+	}
+	// a site whose first deployment failed may not have exported its URL
+	site.URL, _ = outs["websiteUrl"].Value.(string)
+	site.Domain, _ = outs["domain"].Value.(string)
+	site.CertificateStatus, _ = outs["certificateStatus"].Value.(string)
+	return site
+}
+
 // updates the content for an existing site
 func updateHandler(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	var updateReq UpdateSiteReq
-	err := json.NewDecoder(req.Body).Decode(&updateReq)
-	if err != nil {
-		w.WriteHeader(400)
-		fmt.Fprintf(w, "failed to parse create request")
-		return
-	}
-
 	ctx := context.Background()
 	params := mux.Vars(req)
-	stackName := params["id"]
-	program := createPulumiProgram(updateReq.Content)
+	siteID := params["id"]
+	stackName := stackNameFor(req, siteID)
 
-	s, err := auto.SelectStackInlineSource(ctx, stackName, project, program)
+	// the body is either JSON, a multipart form, or a tarball of the site's files
+	updateReq, content, err := readSiteRequest(w, req, updateSiteSchema)
 	if err != nil {
-		if auto.IsSelectStack404Error(err) {
-			w.WriteHeader(404)
-			fmt.Fprintf(w, fmt.Sprintf("stack %q not found", stackName))
-			return
-		}
-
-		w.WriteHeader(500)
-		fmt.Fprintf(w, err.Error())
+		writeErrorf(w, 400, codeBadRequest, siteID, "failed to parse update request: %w", err)
+		return
+	}
+	if err := validateWebhooks(updateReq.Webhooks); err != nil {
+		writeError(w, siteID, badRequest(err))
+		return
+	}
+	if err := validateTags(updateReq.Tags); err != nil {
+		writeError(w, siteID, badRequest(err))
+		return
+	}
+	// changing the region would replace every resource, so it's fixed once the site is created
+	if updateReq.Region != "" || len(updateReq.Provider) > 0 {
+		writeErrorf(w, 400, codeBadRequest, siteID, "the region and provider config of a site can't be changed")
 		return
 	}
-	s.SetConfig(ctx, "aws:region", auto.ConfigValue{Value: "us-west-2"})
 
-	// deploy the stack
-	// we'll write all of the update logs to st	out so we can watch requests get processed
-	upRes, err := s.Up(ctx, optup.ProgressStreams(os.Stdout))
+	// the program is built once we know which template the site was deployed with
+	s, err := siteStacks.selectStack(ctx, stackName, nil)
 	if err != nil {
-		// if we already have another update in progress, return a 409
-		if auto.IsConcurrentUpdateError(err) {
-			w.WriteHeader(409)
-			fmt.Fprintf(w, "stack %q already has update in progress", stackName)
-			return
-		}
+		writeError(w, siteID, err)
+		return
+	}
+	expectedVersion, ok := checkIfMatch(ctx, w, req, s, siteID)
+	if !ok {
+		return
+	}
 
-		w.WriteHeader(500)
-		fmt.Fprintf(w, err.Error())
+	// the new settings are worked out now so that bad requests are turned away, and again once
+	// the operation runs, on top of whatever the operations queued ahead of it deployed
+	apply := func(ctx context.Context) (*siteSettings, pulumi.RunFunc, error) {
+		settings, err := updatedSiteSettings(ctx, s, updateReq.Args, content)
+		if err != nil {
+			return nil, nil, err
+		}
+		if updateReq.Webhooks != nil {
+			settings.Webhooks = updateReq.Webhooks
+		}
+		if updateReq.Tags != nil {
+			settings.Tags = updateReq.Tags
+		}
+		if err := requireContent(settings); err != nil {
+			return nil, nil, badRequest(err)
+		}
+		program, err := settings.program()
+		if err != nil {
+			return nil, nil, badRequest(err)
+		}
+		return settings, program, nil
+	}
+	settings, _, err := apply(ctx)
+	if err != nil {
+		writeError(w, siteID, err)
 		return
 	}
 
-	response := &SiteResponse{
-		ID:  stackName,
-		URL: upRes.Outputs["websiteUrl"].Value.(string),
+	// deploy the stack in the background, the caller can poll the operation for the result
+	op, err := operations.enqueue("update", callerFrom(req).Tenant, siteID, settings.Webhooks, func(ctx context.Context, op *operation) (*SiteResponse, error) {
+		if err := ensureVersion(ctx, s, siteID, expectedVersion); err != nil {
+			return nil, err
+		}
+		settings, program, err := apply(ctx)
+		if err != nil {
+			return nil, err
+		}
+		siteStacks.setProgram(s, program)
+		if err := ensureRegion(ctx, s); err != nil {
+			return nil, err
+		}
+		// record the site's settings so that we can roll back to them later. the stack's config
+		// is only changed once it's this operation's turn, so it can't leak into another's update.
+		if err := settings.save(ctx, s); err != nil {
+			return nil, err
+		}
+		// we'll write all of the update logs to stdout so we can watch requests get processed
+		upRes, err := s.Up(ctx, optup.ProgressStreams(os.Stdout), optup.EventStreams(op.eventStream()))
+		if err != nil {
+			// conflicts are reported as such on the operation, so callers know to retry
+			if auto.IsConcurrentUpdateError(err) {
+				updateConflicts.inc(op.kind)
+			}
+			return nil, err
+		}
+		op.setOutputs(upRes.Outputs)
+		recordResourceChanges(op.kind, upRes.Summary)
+		return siteFromOutputs(siteID, upRes.Outputs), nil
+	})
+	if err != nil {
+		writeError(w, siteID, err)
+		return
 	}
-	json.NewEncoder(w).Encode(&response)
+	writeAccepted(w, op)
 }
 
 // deletes a site
@@ -235,98 +574,85 @@ func deleteHandler(w http.ResponseWriter, req *http.Request) {
 
 	ctx := context.Background()
 	params := mux.Vars(req)
-	stackName := params["id"]
+	siteID := params["id"]
+	stackName := stackNameFor(req, siteID)
 	// program doesn't matter for destroying a stack
-	program := createPulumiProgram("")
+	var program pulumi.RunFunc = nil
 
-	s, err := auto.SelectStackInlineSource(ctx, stackName, project, program)
+	s, err := siteStacks.selectStack(ctx, stackName, program)
 	if err != nil {
-		// if stack doesn't already exist, 404
-		if auto.IsSelectStack404Error(err) {
-			w.WriteHeader(404)
-			fmt.Fprintf(w, fmt.Sprintf("stack %q not found", stackName))
-			return
-		}
-
-		w.WriteHeader(500)
-		fmt.Fprintf(w, err.Error())
+		writeError(w, siteID, err)
 		return
 	}
-	s.SetConfig(ctx, "aws:region", auto.ConfigValue{Value: "us-west-2"})
-
-	// destroy the stack
-	// we'll write all of the logs to stdout so we can watch requests get processed
-	_, err = s.Destroy(ctx, optdestroy.ProgressStreams(os.Stdout))
+	expectedVersion, ok := checkIfMatch(ctx, w, req, s, siteID)
+	if !ok {
+		return
+	}
+	// the stack's history goes away with it, so look up who to notify now
+	hooks, err := siteWebhooks(ctx, s)
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, err.Error())
+		writeError(w, siteID, err)
 		return
 	}
 
-	// delete the stack and all associated history and config
-	err = s.Workspace().RemoveStack(ctx, stackName)
+	// destroy the stack in the background, the caller can poll the operation for the result
+	op, err := operations.enqueue("delete", callerFrom(req).Tenant, siteID, hooks, func(ctx context.Context, op *operation) (*SiteResponse, error) {
+		if err := ensureVersion(ctx, s, siteID, expectedVersion); err != nil {
+			return nil, err
+		}
+		if err := ensureRegion(ctx, s); err != nil {
+			return nil, err
+		}
+		// we'll write all of the logs to stdout so we can watch requests get processed
+		destroyRes, err := s.Destroy(ctx, optdestroy.ProgressStreams(os.Stdout), optdestroy.EventStreams(op.eventStream()))
+		if err != nil {
+			return nil, err
+		}
+		recordResourceChanges(op.kind, destroyRes.Summary)
+		driftStatuses.forget(stackName)
+		// delete the stack and all associated history and config
+		return nil, siteStacks.removeStack(ctx, stackName)
+	})
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, err.Error())
+		writeError(w, siteID, err)
 		return
 	}
-
-	w.WriteHeader(200)
+	writeAccepted(w, op)
 }
 
-// this function defines our pulumi S3 static website in terms of the content that the caller passes in.
-// this allows us to dynamically deploy websites based on user defined values from the POST body.
-func createPulumiProgram(content string) pulumi.RunFunc {
-	return func(ctx *pulumi.Context) error {
-		// our program defines a s3 website.
-		// here we create the bucket
-		siteBucket, err := s3.NewBucket(ctx, "s3-website-bucket", &s3.BucketArgs{
-			Website: s3.BucketWebsiteArgs{
-				IndexDocument: pulumi.String("index.html"),
-			},
-		})
-		if err != nil {
-			return err
-		}
+// gets the status of a queued, running, or completed operation
+func getOperationHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(req)
+	opID := params["id"]
 
-		// here our HTML is defined based on what the caller curries in.
-		indexContent := content
-		// upload our index.html
-		if _, err := s3.NewBucketObject(ctx, "index", &s3.BucketObjectArgs{
-			Bucket:      siteBucket.ID(), // reference to the s3.Bucket object
-			Content:     pulumi.String(indexContent),
-			Key:         pulumi.String("index.html"),               // set the key of the object
-			ContentType: pulumi.String("text/html; charset=utf-8"), // set the MIME type of the file
-		}); err != nil {
-			return err
-		}
+	op, ok := operations.get(callerFrom(req).Tenant, opID)
+	if !ok {
+		writeErrorf(w, 404, codeNotFound, "", "operation %q not found", opID)
+		return
+	}
+	json.NewEncoder(w).Encode(op.response())
+}
 
-		// Set the access policy for the bucket so all objects are readable.
-		if _, err := s3.NewBucketPolicy(ctx, "bucketPolicy", &s3.BucketPolicyArgs{
-			Bucket: siteBucket.ID(), // refer to the bucket created earlier
-			Policy: pulumi.Any(map[string]interface{}{
-				"Version": "2012-10-17",
-				"Statement": []map[string]interface{}{
-					{
-						"Effect":    "Allow",
-						"Principal": "*",
-						"Action": []interface{}{
-							"s3:GetObject",
-						},
-						"Resource": []interface{}{
-							pulumi.Sprintf("arn:aws:s3:::%s/*", siteBucket.ID()), // policy refers to bucket name explicitly
-						},
-					},
-				},
-			}),
-		}); err != nil {
-			return err
-		}
+// responds with 202 and a pointer to the operation that will carry out the request
+func writeAccepted(w http.ResponseWriter, op *operation) {
+	w.Header().Set("Location", "/operations/"+op.id)
+	w.WriteHeader(202)
+	json.NewEncoder(w).Encode(op.response())
+}
 
-		// export the website URL
-		ctx.Export("websiteUrl", siteBucket.WebsiteEndpoint)
-		return nil
+// updatedSiteSettings applies new content, and optionally new template args,
+// on top of the settings a site was last deployed with
+func updatedSiteSettings(ctx context.Context, s siteStack, args json.RawMessage, content *siteContent) (*siteSettings, error) {
+	settings, err := lastSiteSettings(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	settings.Content = content
+	if len(args) > 0 {
+		settings.Args = args
 	}
+	return settings, nil
 }
 
 // ensure plugins runs once before the server boots up
@@ -338,9 +664,10 @@ func ensurePlugins() {
 		fmt.Printf("Failed to setup and run http server: %v\n", err)
 		os.Exit(1)
 	}
-	err = w.InstallPlugin(ctx, "aws", "v3.2.1")
-	if err != nil {
-		fmt.Printf("Failed to install program plugins: %v\n", err)
-		os.Exit(1)
+	for _, p := range requiredPlugins {
+		if err := w.InstallPlugin(ctx, p.name, p.version); err != nil {
+			fmt.Printf("Failed to install program plugins: %v\n", err)
+			os.Exit(1)
+		}
 	}
 }
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+// the server's metrics, served at /metrics in the Prometheus text format
+var (
+	requestsTotal = newMetric("pulumi_over_http_requests_total", "counter",
+		"HTTP requests handled, by route, method, and status code.",
+		"route", "method", "code")
+	requestDuration = newHistogram("pulumi_over_http_request_duration_seconds",
+		"Time taken to handle HTTP requests, by route, method, and status code.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		"route", "method", "code")
+	operationsInFlight = newMetric("pulumi_over_http_operations_in_flight", "gauge",
+		"Automation API operations currently running, by kind.",
+		"kind")
+	operationsQueued = newMetric("pulumi_over_http_operations_queued", "gauge",
+		"Operations waiting for their stack or a free deployment slot.")
+	operationDuration = newHistogram("pulumi_over_http_operation_duration_seconds",
+		"Time taken to run Automation API operations, by kind and result.",
+		[]float64{5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+		"kind", "result")
+	resourceChanges = newMetric("pulumi_over_http_resource_changes_total", "counter",
+		"Resource changes made by operations, by kind and resource operation.",
+		"kind", "op")
+	updateConflicts = newMetric("pulumi_over_http_concurrent_update_conflicts_total", "counter",
+		"Operations rejected because the stack already had an update in progress, by kind.",
+		"kind")
+	readinessChecks = newMetric("pulumi_over_http_readiness_check", "gauge",
+		"Whether each readiness check passed the last time it ran, 1 if it did and 0 if not.",
+		"check")
+)
+
+var allMetrics = []*metric{
+	requestsTotal,
+	requestDuration,
+	operationsInFlight,
+	operationsQueued,
+	operationDuration,
+	resourceChanges,
+	updateConflicts,
+	readinessChecks,
+}
+
+// metric is a counter, gauge, or histogram with a set of labels.
+// each combination of label values is tracked as its own series.
+type metric struct {
+	name    string
+	kind    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	// for histograms, the number of observations in each bucket along with their sum
+	counts []uint64
+	sum    float64
+}
+
+func newMetric(name, kind, help string, labels ...string) *metric {
+	return &metric{
+		name:   name,
+		kind:   kind,
+		help:   help,
+		labels: labels,
+		series: make(map[string]*metricSeries),
+	}
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	m := newMetric(name, "histogram", help, labels...)
+	m.buckets = buckets
+	return m
+}
+
+// get returns the series for the label values, creating it on first use. m.mu must be held.
+func (m *metric) get(labelValues []string) *metricSeries {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s takes %d labels, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\x00")
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: labelValues}
+		if m.kind == "histogram" {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (m *metric) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value += v
+}
+
+func (m *metric) set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labelValues).value = v
+}
+
+func (m *metric) inc(labelValues ...string) {
+	m.add(1, labelValues...)
+}
+
+func (m *metric) dec(labelValues ...string) {
+	m.add(-1, labelValues...)
+}
+
+func (m *metric) observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labelValues)
+	for i, upper := range m.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.value++
+	s.sum += v
+}
+
+// write renders the metric in the Prometheus text exposition format
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, helpEscaper.Replace(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.labelPairs(s, "", ""), formatFloat(s.value))
+			continue
+		}
+		for i, upper := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelPairs(s, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %s\n", m.name, m.labelPairs(s, "le", "+Inf"), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.labelPairs(s, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %s\n", m.name, m.labelPairs(s, "", ""), formatFloat(s.value))
+	}
+}
+
+// labelPairs formats a series' labels as {name="value",...}, with an optional extra label
+func (m *metric) labelPairs(s *metricSeries, extraName, extraValue string) string {
+	var pairs []string
+	for i, name := range m.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(s.labelValues[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, labelEscaper.Replace(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// the text format only has escapes for backslashes and newlines, and in label values for
+// double quotes. anything else, such as Go's \t or \x00, fails to parse.
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// serves every metric in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range allMetrics {
+		m.write(w)
+	}
+}
+
+// metricsMiddleware counts and times every request by the route it matched, rather than its
+// path, so that site and operation IDs don't each create their own series
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: 200}
+		next.ServeHTTP(rec, req)
+
+		route := "unknown"
+		if r := mux.CurrentRoute(req); r != nil {
+			if tmpl, err := r.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		code := strconv.Itoa(rec.status)
+		requestsTotal.inc(route, req.Method, code)
+		requestDuration.observe(time.Since(start).Seconds(), route, req.Method, code)
+	})
+}
+
+// statusRecorder remembers the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets the event stream keep flushing through the recorder
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// recordResourceChanges counts the resource changes from an update's summary
+func recordResourceChanges(kind string, summary auto.UpdateSummary) {
+	if summary.ResourceChanges == nil {
+		return
+	}
+	for op, n := range *summary.ResourceChanges {
+		resourceChanges.add(float64(n), kind, op)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// the server's own metrics parse as the Prometheus text format
+func TestMetricsFormat(t *testing.T) {
+	accepted(t, request(t, "POST", "/sites", CreateSiteReq{ID: "measured", Content: "<h1>hi</h1>"}))
+	accepted(t, request(t, "DELETE", "/sites/measured", nil))
+
+	res := request(t, "GET", "/metrics", nil)
+	if got := res.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected Content-Type %q", got)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	families := parseExposition(t, body)
+	for _, m := range allMetrics {
+		if _, ok := families[m.name]; !ok {
+			t.Errorf("expected %s to be exposed", m.name)
+		}
+	}
+	if samples := families["pulumi_over_http_operation_duration_seconds"]; len(samples) == 0 {
+		t.Error("expected the operations to be timed")
+	}
+}
+
+// label values and help text are escaped the way the text format expects
+func TestMetricsEscaping(t *testing.T) {
+	odd := "a\\b \"quoted\"\nnew line\ttab \x01 é"
+	counter := newMetric("test_escaped_total", "counter", "Help with a \\ and a\nnew line.", "value")
+	counter.inc(odd)
+	histogram := newHistogram("test_escaped_seconds", "Help.", []float64{1, 5}, "value")
+	histogram.observe(0.5, odd)
+	histogram.observe(3, odd)
+	histogram.observe(math.Inf(1), odd)
+
+	var buf bytes.Buffer
+	counter.write(&buf)
+	histogram.write(&buf)
+	families := parseExposition(t, buf.Bytes())
+	samples := families["test_escaped_total"]
+	if len(samples) != 1 || samples[0].labels["value"] != odd || samples[0].value != 1 {
+		t.Fatalf("expected the label value to survive the round trip, got %+v", samples)
+	}
+	if got := len(families["test_escaped_seconds"]); got != 5 {
+		t.Fatalf("expected 3 buckets, a sum, and a count, got %d samples", got)
+	}
+}
+
+type expositionSample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// parseExposition checks the body against the Prometheus text format, failing the test on the
+// first line that breaks it, and returns the samples of each metric family it declares
+func parseExposition(t *testing.T, body []byte) map[string][]expositionSample {
+	t.Helper()
+	families := map[string][]expositionSample{}
+	types := map[string]string{}
+	helps := map[string]bool{}
+	seen := map[string]bool{}
+	var current string
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		fail := func(format string, args ...interface{}) {
+			t.Helper()
+			t.Fatalf("line %d %q: "+format, append([]interface{}{n, line}, args...)...)
+		}
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE "):
+			parts := strings.SplitN(line[len("# TYPE "):], " ", 2)
+			name := parts[0]
+			if !metricNameRE.MatchString(name) || len(parts) != 2 {
+				fail("malformed metadata")
+			}
+			if strings.HasPrefix(line, "# HELP ") {
+				if helps[name] {
+					fail("repeated HELP for %s", name)
+				}
+				helps[name] = true
+				if _, err := unescapeExposition(parts[1], false); err != nil {
+					fail("%v", err)
+				}
+			} else {
+				if _, ok := types[name]; ok {
+					fail("repeated TYPE for %s", name)
+				}
+				if _, ok := families[name]; ok {
+					fail("TYPE for %s after its samples", name)
+				}
+				switch parts[1] {
+				case "counter", "gauge", "histogram", "summary", "untyped":
+				default:
+					fail("unknown type %q", parts[1])
+				}
+				types[name] = parts[1]
+				families[name] = []expositionSample{}
+			}
+			current = name
+		case strings.HasPrefix(line, "#"):
+			continue
+		default:
+			s, err := parseExpositionSample(line)
+			if err != nil {
+				fail("%v", err)
+			}
+			family := s.name
+			if types[current] == "histogram" {
+				for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+					if s.name == current+suffix {
+						family = current
+					}
+				}
+			}
+			if family != current {
+				fail("sample isn't part of the family %s before it", current)
+			}
+			key := s.name + fmtLabels(s.labels)
+			if seen[key] {
+				fail("repeated series")
+			}
+			seen[key] = true
+			families[family] = append(families[family], s)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for name, typ := range types {
+		if typ == "histogram" {
+			checkHistogram(t, name, families[name])
+		}
+	}
+	return families
+}
+
+// checkHistogram makes sure each series' buckets only ever grow, and end with a +Inf bucket
+// that matches its count
+func checkHistogram(t *testing.T, name string, samples []expositionSample) {
+	t.Helper()
+	last := map[string]float64{}
+	inf := map[string]float64{}
+	for _, s := range samples {
+		labels := map[string]string{}
+		for k, v := range s.labels {
+			if k != "le" {
+				labels[k] = v
+			}
+		}
+		key := fmtLabels(labels)
+		switch s.name {
+		case name + "_bucket":
+			le, ok := s.labels["le"]
+			if !ok {
+				t.Fatalf("%s bucket without an le label", name)
+			}
+			if s.value < last[key] {
+				t.Fatalf("%s%s buckets aren't cumulative", name, key)
+			}
+			last[key] = s.value
+			if le == "+Inf" {
+				inf[key] = s.value
+			}
+		case name + "_count":
+			if v, ok := inf[key]; !ok || v != s.value {
+				t.Fatalf("%s%s has a count of %v but its +Inf bucket is %v", name, key, s.value, v)
+			}
+		}
+	}
+}
+
+// parseExpositionSample parses a line such as name{label="value"} 1
+func parseExpositionSample(line string) (expositionSample, error) {
+	s := expositionSample{labels: map[string]string{}}
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 {
+		return s, fmt.Errorf("missing value")
+	}
+	s.name = line[:end]
+	if !metricNameRE.MatchString(s.name) {
+		return s, fmt.Errorf("invalid metric name %q", s.name)
+	}
+	rest := line[end:]
+	if strings.HasPrefix(rest, "{") {
+		rest = rest[1:]
+		for !strings.HasPrefix(rest, "}") {
+			eq := strings.Index(rest, `="`)
+			if eq < 0 {
+				return s, fmt.Errorf("malformed labels")
+			}
+			name := rest[:eq]
+			if !labelNameRE.MatchString(name) {
+				return s, fmt.Errorf("invalid label name %q", name)
+			}
+			if _, ok := s.labels[name]; ok {
+				return s, fmt.Errorf("repeated label %q", name)
+			}
+			value, n, err := readQuoted(rest[eq+2:])
+			if err != nil {
+				return s, err
+			}
+			s.labels[name] = value
+			rest = rest[eq+2+n:]
+			if strings.HasPrefix(rest, ",") {
+				rest = rest[1:]
+			} else if !strings.HasPrefix(rest, "}") {
+				return s, fmt.Errorf("malformed labels")
+			}
+		}
+		rest = rest[1:]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 || !strings.HasPrefix(rest, " ") {
+		return s, fmt.Errorf("malformed value")
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, fmt.Errorf("invalid value %q", fields[0])
+	}
+	s.value = v
+	return s, nil
+}
+
+// readQuoted reads an escaped label value up to its closing quote, returning the value and how
+// many bytes it took up, including the quote
+func readQuoted(s string) (string, int, error) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			v, err := unescapeExposition(s[:i], true)
+			return v, i + 1, err
+		case '\n':
+			return "", 0, fmt.Errorf("unescaped new line in a label value")
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated label value")
+}
+
+// unescapeExposition undoes the text format's escapes, which are \\ and \n, plus \" in label values
+func unescapeExposition(s string, label bool) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("trailing backslash")
+		}
+		switch {
+		case s[i] == '\\':
+			b.WriteByte('\\')
+		case s[i] == 'n':
+			b.WriteByte('\n')
+		case s[i] == '"' && label:
+			b.WriteByte('"')
+		default:
+			return "", fmt.Errorf("invalid escape \\%c", s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+func fmtLabels(labels map[string]string) string {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+strconv.Quote(v))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
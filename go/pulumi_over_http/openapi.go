@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pulumi/automation-api-examples/go/pulumi_over_http/api"
+)
+
+// the largest JSON body we'll read for requests that don't carry site content
+const maxJSONBodyBytes = 1 << 20
+
+// schemas for the JSON request bodies. every body is validated against its schema before it's
+// decoded, so that malformed requests are rejected with every problem listed before any
+// Automation API call runs. they're also published in the OpenAPI document.
+var (
+	createSiteSchema = &jsonSchema{
+		Type:                 "object",
+		Required:             []string{"id"},
+		AdditionalProperties: boolPtr(false),
+		Properties: map[string]*jsonSchema{
+			"id": {
+				Type:        "string",
+				Description: "Site ID, unique within the caller's tenant.",
+				Pattern:     validName.String(),
+			},
+			"content":  {Type: "string", Description: "HTML served as the site's index document. Required unless the template ignores content.", MinLength: intPtr(1)},
+			"template": {Type: "string", Description: "Template to build the site from, see GET /templates.", MinLength: intPtr(1)},
+			"args":     {Type: "object", Description: "Arguments for the template, validated against its schema."},
+			"webhooks": webhooksSchema,
+			"tags":     tagsSchema,
+			"ttl":      {Type: "string", Description: "How long the site lives for before it's destroyed, such as 72h.", MinLength: intPtr(1)},
+			"region":   {Type: "string", Description: "AWS region to deploy the site to.", MinLength: intPtr(1)},
+			"provider": {Type: "object", Description: "Other provider config keys from the server's allow-list."},
+			"domain":   {Type: "string", Description: "Custom domain to serve the site from over https, within one of the server's hosted zones.", MinLength: intPtr(1)},
+		},
+	}
+	updateSiteSchema = &jsonSchema{
+		Type:                 "object",
+		AdditionalProperties: boolPtr(false),
+		Properties: map[string]*jsonSchema{
+			// bodies have always been allowed to repeat the site's ID, as the create body has it
+			"id":       {Type: "string", Description: "Ignored, the site is the one named in the path."},
+			"content":  {Type: "string", Description: "HTML served as the site's index document. Required unless the site's template ignores content.", MinLength: intPtr(1)},
+			"args":     {Type: "object", Description: "Replaces the site's template arguments."},
+			"webhooks": webhooksSchema,
+			"tags":     tagsSchema,
+		},
+	}
+	patchSiteSchema = &jsonSchema{
+		Type:                 "object",
+		Required:             []string{"ttl"},
+		AdditionalProperties: boolPtr(false),
+		Properties: map[string]*jsonSchema{
+			"ttl": {Type: "string", Description: "Sets the site to expire this long from now, or never if empty."},
+		},
+	}
+	cloneSiteSchema = &jsonSchema{
+		Type:                 "object",
+		Required:             []string{"id"},
+		AdditionalProperties: boolPtr(false),
+		Properties: map[string]*jsonSchema{
+			"id": {Type: "string", Description: "ID of the new site.", Pattern: validName.String()},
+		},
+	}
+	// importStateSchema checks the shape of a deployment as written by `pulumi stack export`,
+	// so that a truncated or hand-edited file is turned away before the CLI sees it
+	importStateSchema = &jsonSchema{
+		Type:                 "object",
+		Required:             []string{"version", "deployment"},
+		AdditionalProperties: boolPtr(false),
+		Properties: map[string]*jsonSchema{
+			"version": {Type: "integer", Description: "Version of the deployment format.", Minimum: floatPtr(1), Maximum: floatPtr(3)},
+			"deployment": {
+				Type:     "object",
+				Required: []string{"manifest"},
+				Properties: map[string]*jsonSchema{
+					"manifest": {
+						Type:     "object",
+						Required: []string{"time", "magic", "version"},
+					},
+					"secrets_providers": {
+						Type:     "object",
+						Required: []string{"type"},
+					},
+					"resources": {
+						Type: "array",
+						Items: &jsonSchema{
+							Type:     "object",
+							Required: []string{"urn", "type", "custom"},
+							Properties: map[string]*jsonSchema{
+								"urn":      {Type: "string", Pattern: "^urn:pulumi:"},
+								"type":     {Type: "string", MinLength: intPtr(1)},
+								"custom":   {Type: "boolean"},
+								"parent":   {Type: "string"},
+								"provider": {Type: "string"},
+							},
+						},
+					},
+					"pending_operations": {
+						Type: "array",
+						Items: &jsonSchema{
+							Type:     "object",
+							Required: []string{"resource", "type"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	webhooksSchema = &jsonSchema{
+		Type:        "array",
+		Description: "Webhooks notified when an operation on the site finishes.",
+		Items:       &jsonSchema{Type: "string", Pattern: "^https?://"},
+	}
+	tagsSchema = &jsonSchema{
+		Type:        "object",
+		Description: "Labels that sites can be filtered by. Values must be strings.",
+	}
+)
+
+// decodeJSON reads a JSON body, checks it against the schema, and decodes it into v
+func decodeJSON(body io.Reader, schema *jsonSchema, v interface{}) error {
+	return decodeJSONLimit(body, maxJSONBodyBytes, schema, v)
+}
+
+// decodeJSONLimit is decodeJSON for bodies that may be larger than usual
+func decodeJSONLimit(body io.Reader, limit int64, schema *jsonSchema, v interface{}) error {
+	data, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return uploadErrorf("failed to read request: %v", err)
+	}
+	if int64(len(data)) > limit {
+		return uploadErrorf("request body is larger than %d bytes", limit)
+	}
+	if err := schema.validateJSON(data); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return uploadErrorf("failed to parse request: %v", err)
+	}
+	return nil
+}
+
+// requireContent rejects sites with nothing to serve, unless their template doesn't need any
+func requireContent(settings *siteSettings) error {
+	if t, ok := templates[settings.Template]; ok && t.IgnoresContent {
+		return nil
+	}
+	if settings.Content == nil || settings.Content.isEmpty() {
+		return fmt.Errorf("content must not be empty for template %q", settings.Template)
+	}
+	return nil
+}
+
+// routeDoc describes a route in the OpenAPI document
+type routeDoc struct {
+	summary string
+	query   []queryParam
+	// the schema of the JSON request body, if the route takes one
+	request *jsonSchema
+	// the status and type of a successful response. responses that aren't JSON set contentType.
+	status      int
+	response    interface{}
+	contentType string
+}
+
+type queryParam struct {
+	name        string
+	schema      *jsonSchema
+	description string
+}
+
+var (
+	stringParam  = &jsonSchema{Type: "string"}
+	integerParam = &jsonSchema{Type: "integer"}
+	timeParam    = &jsonSchema{Type: "string", Format: "date-time"}
+)
+
+// routeDocs documents the routes registered on the router, keyed by method and path template.
+// routes without an entry are still listed in the document, just without schemas.
+var routeDocs = map[string]*routeDoc{
+	"POST /sites": {
+		summary:  "Create a site. Also accepts multipart/form-data and application/gzip uploads.",
+		request:  createSiteSchema,
+		status:   202,
+		response: api.OperationResponse{},
+	},
+	"GET /sites": {
+		summary: "List sites",
+		query: []queryParam{
+			{"prefix", stringParam, "Only list sites whose ID starts with this."},
+			{"tag", stringParam, "key=value, or key to match any value. Can be repeated."},
+			{"updatedSince", timeParam, "Only list sites last updated at or after this time."},
+			{"updatedBefore", timeParam, "Only list sites last updated before this time."},
+			{"expand", &jsonSchema{Type: "string", Enum: []interface{}{"summary"}}, "Include a summary of each site's stack."},
+			{"limit", integerParam, "Most sites to return."},
+			{"cursor", stringParam, "nextCursor of the previous page."},
+		},
+		status:   200,
+		response: api.ListSitesResponse{},
+	},
+	"GET /sites/{id}": {
+		summary:  "Get a site",
+		status:   200,
+		response: api.SiteResponse{},
+	},
+	"PUT /sites/{id}": {
+		summary:  "Update a site. Also accepts multipart/form-data and application/gzip uploads.",
+		request:  updateSiteSchema,
+		status:   202,
+		response: api.OperationResponse{},
+	},
+	"PATCH /sites/{id}": {
+		summary:  "Change a site's TTL without redeploying it",
+		request:  patchSiteSchema,
+		status:   200,
+		response: api.SiteResponse{},
+	},
+	"DELETE /sites/{id}": {
+		summary:  "Destroy a site",
+		status:   202,
+		response: api.OperationResponse{},
+	},
+	"POST /sites/{id}/preview": {
+		summary:  "Preview the changes an update would make",
+		request:  updateSiteSchema,
+		status:   200,
+		response: api.PreviewSiteResponse{},
+	},
+	"POST /sites/{id}/refresh": {
+		summary:  "Refresh a site's state from its cloud resources",
+		status:   202,
+		response: api.OperationResponse{},
+	},
+	"GET /sites/{id}/drift": {
+		summary:  "Check which of a site's resources have drifted, without changing the site",
+		status:   200,
+		response: api.DriftResponse{},
+	},
+	"GET /sites/{id}/history": {
+		summary: "List a site's updates",
+		query: []queryParam{
+			{"pageSize", integerParam, "Updates per page."},
+			{"page", integerParam, "Page to return, starting at 1."},
+		},
+		status:   200,
+		response: api.SiteHistoryResponse{},
+	},
+	"POST /sites/{id}/rollback": {
+		summary:  "Redeploy a site as it was at an earlier version",
+		query:    []queryParam{{"version", integerParam, "Version to roll back to."}},
+		status:   202,
+		response: api.OperationResponse{},
+	},
+	"GET /sites/{id}/recovery": {
+		summary:  "List the operations left pending in a site's state",
+		status:   200,
+		response: api.SiteRecoveryResponse{},
+	},
+	"POST /sites/{id}/recover": {
+		summary:  "Clear a site's pending operations and refresh it",
+		status:   202,
+		response: api.OperationResponse{},
+	},
+	"GET /recovery": {
+		summary:  "List the sites left with pending operations",
+		status:   200,
+		response: api.ListRecoveriesResponse{},
+	},
+	"GET /sites/{id}/state": {
+		summary:  "Export a site's state. Admins only.",
+		status:   200,
+		response: api.SiteState{},
+	},
+	"PUT /sites/{id}/state": {
+		summary:  "Replace a site's state with one exported earlier. Admins only.",
+		request:  importStateSchema,
+		status:   200,
+		response: api.SiteResponse{},
+	},
+	"POST /sites/{id}/clone": {
+		summary:  "Copy a site's state and config to a new site. Admins only.",
+		request:  cloneSiteSchema,
+		status:   201,
+		response: api.SiteResponse{},
+	},
+	"GET /operations/{id}": {
+		summary:  "Get an operation",
+		status:   200,
+		response: api.OperationResponse{},
+	},
+	"GET /templates": {
+		summary:  "List the templates sites can be created from",
+		status:   200,
+		response: api.ListTemplatesResponse{},
+	},
+	"GET /webhooks/failures": {
+		summary:  "List webhook deliveries that ran out of attempts",
+		status:   200,
+		response: api.ListWebhookFailuresResponse{},
+	},
+	"GET /audit": {
+		summary: "List the audit log",
+		query: []queryParam{
+			{"site", stringParam, "Only list records for this site."},
+			{"caller", stringParam, "Only list records made by this caller."},
+			{"since", timeParam, "Only list records made at or after this time."},
+			{"limit", integerParam, "Most records to return."},
+			{"cursor", stringParam, "nextCursor of the previous page."},
+			{"format", &jsonSchema{Type: "string", Enum: []interface{}{"jsonl"}}, "Export every matching record as JSON lines."},
+		},
+		status:   200,
+		response: api.ListAuditResponse{},
+	},
+	"GET /sites/{id}/operations/{op}/events": {
+		summary:     "Stream an operation's engine events as server-sent events",
+		status:      200,
+		contentType: "text/event-stream",
+	},
+}
+
+// the OpenAPI 3 document, only as much of it as we use
+
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIOperation struct {
+	Summary     string                      `json:"summary,omitempty"`
+	Parameters  []openAPIParameter          `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+}
+
+type openAPIParameter struct {
+	Name        string      `json:"name"`
+	In          string      `json:"in"`
+	Required    bool        `json:"required,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Schema      *jsonSchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                         `json:"required"`
+	Content  map[string]*openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                       `json:"description"`
+	Content     map[string]*openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *jsonSchema `json:"schema,omitempty"`
+}
+
+type openAPIComponents struct {
+	Schemas map[string]*jsonSchema `json:"schemas"`
+}
+
+var pathParamPattern = regexp.MustCompile(`{([^}]+)}`)
+
+// newOpenAPIDocument describes every route registered on the router
+func newOpenAPIDocument(router *mux.Router) (*openAPIDocument, error) {
+	doc := &openAPIDocument{
+		OpenAPI:    "3.0.3",
+		Info:       openAPIInfo{Title: project, Version: "1.0.0"},
+		Paths:      make(map[string]map[string]*openAPIOperation),
+		Components: openAPIComponents{Schemas: make(map[string]*jsonSchema)},
+	}
+	errorSchema := schemaFor(reflect.TypeOf(api.ErrorResponse{}), doc.Components.Schemas)
+
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			op := &openAPIOperation{
+				Responses: map[string]*openAPIResponse{
+					"default": {
+						Description: "Error",
+						Content:     map[string]*openAPIMediaType{"application/json": {Schema: errorSchema}},
+					},
+				},
+			}
+			for _, m := range pathParamPattern.FindAllStringSubmatch(path, -1) {
+				op.Parameters = append(op.Parameters, openAPIParameter{Name: m[1], In: "path", Required: true, Schema: stringParam})
+			}
+
+			if d, ok := routeDocs[method+" "+path]; ok {
+				op.Summary = d.summary
+				for _, q := range d.query {
+					op.Parameters = append(op.Parameters, openAPIParameter{Name: q.name, In: "query", Description: q.description, Schema: q.schema})
+				}
+				if d.request != nil {
+					op.RequestBody = &openAPIRequestBody{
+						Required: true,
+						Content:  map[string]*openAPIMediaType{"application/json": {Schema: d.request}},
+					}
+				}
+				res := &openAPIResponse{Description: http.StatusText(d.status)}
+				switch {
+				case d.contentType != "":
+					res.Content = map[string]*openAPIMediaType{d.contentType: {}}
+				case d.response != nil:
+					res.Content = map[string]*openAPIMediaType{
+						"application/json": {Schema: schemaFor(reflect.TypeOf(d.response), doc.Components.Schemas)},
+					}
+				}
+				op.Responses[fmt.Sprint(d.status)] = res
+			}
+
+			if doc.Paths[path] == nil {
+				doc.Paths[path] = make(map[string]*openAPIOperation)
+			}
+			doc.Paths[path][strings.ToLower(method)] = op
+		}
+		return nil
+	})
+	return doc, err
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schemaFor describes a response type. structs from the api package become components that
+// are referenced by name, so that types used in several responses are only described once.
+func schemaFor(t reflect.Type, components map[string]*jsonSchema) *jsonSchema {
+	switch t {
+	case timeType:
+		return &jsonSchema{Type: "string", Format: "date-time"}
+	case rawMessageType:
+		// any JSON value
+		return &jsonSchema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaFor(t.Elem(), components)
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &jsonSchema{Type: "array", Items: schemaFor(t.Elem(), components)}
+	case reflect.Map:
+		return &jsonSchema{Type: "object"}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, components)
+		}
+		ref := &jsonSchema{Ref: "#/components/schemas/" + t.Name()}
+		if _, ok := components[t.Name()]; !ok {
+			// reserve the name first in case the type refers to itself
+			components[t.Name()] = &jsonSchema{}
+			*components[t.Name()] = *structSchema(t, components)
+		}
+		return ref
+	}
+	return &jsonSchema{}
+}
+
+func structSchema(t reflect.Type, components map[string]*jsonSchema) *jsonSchema {
+	s := &jsonSchema{Type: "object", Properties: make(map[string]*jsonSchema)}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		name := parts[0]
+		// embedded structs without a name have their fields promoted
+		if f.Anonymous && name == "" {
+			embedded := structSchema(f.Type, components)
+			for k, v := range embedded.Properties {
+				s.Properties[k] = v
+			}
+			s.Required = append(s.Required, embedded.Required...)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = schemaFor(f.Type, components)
+		omitEmpty := false
+		for _, p := range parts[1:] {
+			omitEmpty = omitEmpty || p == "omitempty"
+		}
+		if !omitEmpty && f.Type.Kind() != reflect.Ptr {
+			s.Required = append(s.Required, name)
+		}
+	}
+	sort.Strings(s.Required)
+	return s
+}
+
+// serves the OpenAPI document for the API
+func openAPIHandler(doc *openAPIDocument) http.HandlerFunc {
+	body, err := json.Marshal(doc)
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err != nil {
+			writeError(w, "", err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pulumi/automation-api-examples/go/pulumi_over_http/api"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+// the statuses an operation moves through
+const (
+	OperationQueued    = api.OperationQueued
+	OperationRunning   = api.OperationRunning
+	OperationSucceeded = api.OperationSucceeded
+	OperationFailed    = api.OperationFailed
+)
+
+// errQueueFull is returned when the operation queue can't accept any more work
+var errQueueFull = errors.New("operation queue is full")
+
+// errShuttingDown is returned for operations that arrive, or were still queued, once the server starts shutting down
+var errShuttingDown = errors.New("server is shutting down")
+
+// runFunc performs the Automation API calls for an operation and returns the resulting site, if any.
+// the operation is passed along so that engine events can be recorded via op.eventStream()
+type runFunc func(ctx context.Context, op *operation) (*SiteResponse, error)
+
+// operation tracks a single asynchronous mutation of a site
+type operation struct {
+	mu sync.Mutex
+
+	id       string
+	kind     string
+	tenant   string
+	siteID   string
+	webhooks []string
+	run      runFunc
+
+	status     OperationStatus
+	err        error
+	site       *SiteResponse
+	outputs    map[string]interface{}
+	createdAt  time.Time
+	startedAt  *time.Time
+	finishedAt *time.Time
+
+	// engine events recorded so far, and a channel that is closed
+	// (and replaced) every time the log grows or the operation finishes
+	events  []apitype.EngineEvent
+	changed chan struct{}
+	// streams tracks the event streams still being read, so that every event
+	// is recorded before the operation finishes
+	streams sync.WaitGroup
+	// ran is closed once run returns, after which nothing more is sent on the event streams
+	ran chan struct{}
+
+	// the queue the operation was enqueued on, and its place in line for its stack
+	queue  *operationQueue
+	ticket *lockTicket
+}
+
+// response returns a point in time snapshot of the operation suitable for returning to callers
+func (op *operation) response() *OperationResponse {
+	// the queue's locks are taken before op.mu so that they're never held together
+	depth := op.queue.queued()
+	ahead := op.ticket.ahead()
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	res := &OperationResponse{
+		ID:         op.id,
+		Kind:       op.kind,
+		SiteID:     op.siteID,
+		Status:     op.status,
+		Site:       op.site,
+		CreatedAt:  op.createdAt,
+		StartedAt:  op.startedAt,
+		FinishedAt: op.finishedAt,
+		QueueDepth: depth,
+	}
+	if op.status == OperationQueued {
+		res.Ahead = ahead
+	}
+	if op.err != nil {
+		_, res.Error = errorResponse(op.err, op.siteID)
+	}
+	return res
+}
+
+// eventStream returns a channel to hand to the Automation API via optup.EventStreams and friends.
+// every event received on it is appended to the operation's log. the Automation API closes
+// the channel once the command completes, but only if the command got as far as running the
+// CLI, so the log also stops once the operation's run returns.
+func (op *operation) eventStream() chan<- events.EngineEvent {
+	ch := make(chan events.EngineEvent)
+	op.streams.Add(1)
+	go func() {
+		defer op.streams.Done()
+		for {
+			var e events.EngineEvent
+			select {
+			case evt, ok := <-ch:
+				if !ok {
+					return
+				}
+				e = evt
+			case <-op.ran:
+				return
+			}
+			if e.Error != nil {
+				fmt.Printf("operation %s: failed to read engine event: %v\n", op.id, e.Error)
+				continue
+			}
+			op.mu.Lock()
+			op.events = append(op.events, e.EngineEvent)
+			op.notify()
+			op.mu.Unlock()
+		}
+	}()
+	return ch
+}
+
+// eventsSince returns the events recorded after the first n, a channel that will be closed
+// when more events arrive, and whether the operation has finished
+func (op *operation) eventsSince(n int) ([]apitype.EngineEvent, <-chan struct{}, bool) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	var evts []apitype.EngineEvent
+	if n < len(op.events) {
+		evts = append(evts, op.events[n:]...)
+	}
+	done := op.status == OperationSucceeded || op.status == OperationFailed
+	return evts, op.changed, done
+}
+
+// notify wakes up anyone waiting on op.changed. op.mu must be held.
+func (op *operation) notify() {
+	close(op.changed)
+	op.changed = make(chan struct{})
+}
+
+func (op *operation) start() {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	now := time.Now()
+	op.status = OperationRunning
+	op.startedAt = &now
+	op.notify()
+}
+
+func (op *operation) finish(site *SiteResponse, err error) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	now := time.Now()
+	op.finishedAt = &now
+	op.site = site
+	// failed updates report why in their diagnostics, which are more useful than the CLI's exit status
+	op.err = withDiagnostics(err, op.events)
+	if err != nil {
+		op.status = OperationFailed
+	} else {
+		op.status = OperationSucceeded
+	}
+	op.notify()
+}
+
+// operationQueue runs operations in the background so that long running deployments don't hold
+// HTTP requests open. operations on the same stack run one at a time, in the order they were
+// enqueued, and no more than deploymentSlots allows run at once across every stack.
+type operationQueue struct {
+	mu  sync.Mutex
+	ops map[string]*operation
+	// when each finished operation finished, and how long finished operations are kept for
+	finished  map[string]time.Time
+	retention time.Duration
+	// how many operations are waiting to run, and the most that can be
+	waiting int
+	depth   int
+
+	// set once the server starts shutting down, after which no new operations are started
+	draining bool
+	// the operations currently running, with the functions that cancel their context
+	running map[*operation]context.CancelFunc
+	active  sync.WaitGroup
+}
+
+// newOperationQueue creates a queue that holds at most depth operations waiting to run, and
+// forgets operations, along with their events, once they've been finished for retention
+func newOperationQueue(depth int, retention time.Duration) *operationQueue {
+	return &operationQueue{
+		ops:       make(map[string]*operation),
+		finished:  make(map[string]time.Time),
+		retention: retention,
+		depth:     depth,
+		running:   make(map[*operation]context.CancelFunc),
+	}
+}
+
+// enqueue records a new operation and schedules it to run once its stack is free.
+// the webhooks are notified along with the global ones once it finishes.
+func (q *operationQueue) enqueue(kind, tenant, siteID string, hooks []string, run runFunc) (*operation, error) {
+	id, err := newOperationID()
+	if err != nil {
+		return nil, err
+	}
+	op := &operation{
+		id:        id,
+		kind:      kind,
+		tenant:    tenant,
+		siteID:    siteID,
+		webhooks:  hooks,
+		run:       run,
+		status:    OperationQueued,
+		createdAt: time.Now(),
+		changed:   make(chan struct{}),
+		ran:       make(chan struct{}),
+		queue:     q,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	for id, finishedAt := range q.finished {
+		if now.Sub(finishedAt) > q.retention {
+			delete(q.ops, id)
+			delete(q.finished, id)
+		}
+	}
+	if q.draining {
+		return nil, errShuttingDown
+	}
+	if q.waiting >= q.depth {
+		return nil, errQueueFull
+	}
+	q.waiting++
+	operationsQueued.inc()
+	// take a place in line for the stack now, so that operations on it run in the order they arrived
+	op.ticket = stackLocks.queue(tenantStackName(tenant, siteID))
+	q.ops[id] = op
+	go q.work(op)
+	return op, nil
+}
+
+// queued returns how many operations are waiting to run
+func (q *operationQueue) queued() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiting
+}
+
+// get looks up an operation by ID. operations belonging to other tenants, and those that
+// finished longer ago than the queue keeps them for, aren't found.
+func (q *operationQueue) get(tenant, id string) (*operation, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	op, ok := q.ops[id]
+	if !ok || op.tenant != tenant {
+		return nil, false
+	}
+	if finishedAt, ok := q.finished[id]; ok && time.Since(finishedAt) > q.retention {
+		return nil, false
+	}
+	return op, true
+}
+
+// work waits for the operation's turn on its stack and a free deployment slot, then runs it
+func (q *operationQueue) work(op *operation) {
+	<-op.ticket.ready
+	deploymentSlots.acquire(context.Background())
+	defer op.ticket.release()
+	defer deploymentSlots.release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if !q.begin(op, cancel) {
+		// the server is shutting down, so don't start anything new
+		op.start()
+		op.finish(nil, errShuttingDown)
+		webhooks.operationFinished(op)
+		audit.operationFinished(op)
+		q.retire(op)
+		return
+	}
+
+	op.start()
+	operationsInFlight.inc(op.kind)
+	start := time.Now()
+	site, err := op.run(ctx, op)
+	close(op.ran)
+	op.streams.Wait()
+	operationsInFlight.dec(op.kind)
+	result := OperationSucceeded
+	if err != nil {
+		result = OperationFailed
+	}
+	operationDuration.observe(time.Since(start).Seconds(), op.kind, string(result))
+	if err != nil {
+		fmt.Printf("operation %s (%s %q) failed: %v\n", op.id, op.kind, tenantStackName(op.tenant, op.siteID), err)
+	}
+	op.finish(site, err)
+	webhooks.operationFinished(op)
+	audit.operationFinished(op)
+	q.end(op)
+}
+
+// retire starts the clock on how long a finished operation is kept for
+func (q *operationQueue) retire(op *operation) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.finished[op.id] = time.Now()
+}
+
+// begin takes the operation off the waiting count and marks it as running, unless the queue is draining
+func (q *operationQueue) begin(op *operation, cancel context.CancelFunc) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.waiting--
+	operationsQueued.dec()
+	if q.draining {
+		return false
+	}
+	q.running[op] = cancel
+	q.active.Add(1)
+	return true
+}
+
+func (q *operationQueue) end(op *operation) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.running, op)
+	q.finished[op.id] = time.Now()
+	q.active.Done()
+}
+
+func newOperationID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// opTracker remembers the operations a background job queued for each stack, so that the job
+// doesn't queue another for a stack while the last is still waiting or running
+type opTracker struct {
+	sync.Mutex
+	ops map[string]*operation
+}
+
+func newOpTracker() *opTracker {
+	return &opTracker{ops: make(map[string]*operation)}
+}
+
+// busy reports whether the operation queued for the stack hasn't finished yet
+func (t *opTracker) busy(stackName string) bool {
+	t.Lock()
+	defer t.Unlock()
+	op, ok := t.ops[stackName]
+	if !ok {
+		return false
+	}
+	if op.response().FinishedAt != nil {
+		delete(t.ops, stackName)
+		return false
+	}
+	return true
+}
+
+func (t *opTracker) track(stackName string, op *operation) {
+	t.Lock()
+	defer t.Unlock()
+	t.ops[stackName] = op
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optpreview"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+// previews the changes an update to a site would make without applying them. the caller waits
+// for the result, so rather than queue behind the site's operations a preview is turned away
+// while there are any, and it's cancelled if the caller goes away.
+func previewHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := context.Background()
+	params := mux.Vars(req)
+	siteID := params["id"]
+	stackName := stackNameFor(req, siteID)
+
+	// previews accept the same bodies as updates
+	updateReq, content, err := readSiteRequest(w, req, updateSiteSchema)
+	if err != nil {
+		writeErrorf(w, 400, codeBadRequest, siteID, "failed to parse preview request: %w", err)
+		return
+	}
+
+	// the program is built once we know which template the site was deployed with
+	s, err := siteStacks.selectStack(ctx, stackName, nil)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	release, err := tryLockStack(req.Context(), stackName)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	defer release()
+
+	settings, err := updatedSiteSettings(ctx, s, updateReq.Args, content)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	if err := requireContent(settings); err != nil {
+		writeError(w, siteID, badRequest(err))
+		return
+	}
+	program, err := settings.program()
+	if err != nil {
+		writeError(w, siteID, badRequest(err))
+		return
+	}
+	siteStacks.setProgram(s, program)
+	if err := ensureRegion(ctx, s); err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+
+	// collect the steps the engine plans to take for each resource
+	evts := make(chan events.EngineEvent)
+	changes := collectResourceChanges(evts)
+	stream, finish := teeEvents(evts)
+	_, err = s.Preview(req.Context(), optpreview.ProgressStreams(os.Stdout), optpreview.EventStreams(stream))
+	recorded := finish()
+	if err != nil {
+		if auto.IsConcurrentUpdateError(err) {
+			updateConflicts.inc("preview")
+		}
+		writeError(w, siteID, withDiagnostics(err, recorded))
+		return
+	}
+
+	res := <-changes
+	response := &PreviewSiteResponse{
+		ID:      siteID,
+		Summary: summarizeChanges(res),
+		Changes: res,
+	}
+	json.NewEncoder(w).Encode(&response)
+}
+
+// collectResourceChanges reads engine events until the channel is closed and sends back
+// the change planned or made for each resource, skipping resources that stay the same
+func collectResourceChanges(evts <-chan events.EngineEvent) <-chan []ResourceChange {
+	out := make(chan []ResourceChange, 1)
+	go func() {
+		changes := []ResourceChange{}
+		seen := make(map[string]int)
+		for e := range evts {
+			if e.ResourcePreEvent == nil {
+				continue
+			}
+			md := e.ResourcePreEvent.Metadata
+			op := normalizeOp(md.Op)
+			if op == "same" {
+				continue
+			}
+
+			// replacements show up as several steps against the same URN, so only keep the first
+			if i, ok := seen[md.URN]; ok {
+				changes[i].Diffs = mergeDiffs(changes[i].Diffs, md.Diffs)
+				continue
+			}
+			seen[md.URN] = len(changes)
+			changes = append(changes, ResourceChange{
+				URN:   md.URN,
+				Type:  md.Type,
+				Op:    op,
+				Diffs: md.Diffs,
+			})
+		}
+		out <- changes
+	}()
+	return out
+}
+
+// normalizeOp folds the various engine step kinds into create, update, replace, delete, or same
+func normalizeOp(op apitype.OpType) string {
+	switch op {
+	case apitype.OpSame, apitype.OpRead, apitype.OpRefresh:
+		return "same"
+	case apitype.OpCreate, apitype.OpImport:
+		return "create"
+	case apitype.OpUpdate:
+		return "update"
+	case apitype.OpDelete, apitype.OpReadDiscard, apitype.OpDiscardReplaced:
+		return "delete"
+	}
+	if strings.Contains(string(op), "replace") {
+		return "replace"
+	}
+	return string(op)
+}
+
+// summarizeChanges counts the resource changes by kind
+func summarizeChanges(changes []ResourceChange) map[string]int {
+	summary := map[string]int{
+		"create":  0,
+		"update":  0,
+		"replace": 0,
+		"delete":  0,
+	}
+	for _, c := range changes {
+		summary[c.Op]++
+	}
+	return summary
+}
+
+func mergeDiffs(a, b []string) []string {
+	for _, d := range b {
+		found := false
+		for _, existing := range a {
+			if existing == d {
+				found = true
+				break
+			}
+		}
+		if !found {
+			a = append(a, d)
+		}
+	}
+	return a
+}
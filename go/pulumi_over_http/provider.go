@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+const regionConfigKey = "aws:region"
+
+// the regions sites can be deployed to and the other provider config keys callers may set,
+// configured with -allowed-regions and -allowed-provider-config
+var (
+	defaultRegion         = "us-west-2"
+	allowedRegions        = map[string]bool{"us-west-2": true}
+	allowedProviderConfig = map[string]bool{}
+)
+
+// splitList turns a comma separated flag into a set
+func splitList(raw string) map[string]bool {
+	set := make(map[string]bool)
+	for _, v := range strings.Split(raw, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			set[v] = true
+		}
+	}
+	return set
+}
+
+// validateProviderConfig checks the region and provider config sent with a create request
+func validateProviderConfig(region string, cfg map[string]string) error {
+	if region != "" && !allowedRegions[region] {
+		return fmt.Errorf("region %q is not allowed, must be one of %s", region, strings.Join(sortedRegions(), ", "))
+	}
+	for k := range cfg {
+		if k == regionConfigKey {
+			return fmt.Errorf("set the region with the region field rather than %q", k)
+		}
+		if !allowedProviderConfig[k] {
+			return fmt.Errorf("provider config %q is not allowed", k)
+		}
+	}
+	return nil
+}
+
+// addProviderConfig adds provider config sent as key=value in a form field or query parameter
+func addProviderConfig(siteReq *CreateSiteReq, raw string) error {
+	kv := strings.SplitN(raw, "=", 2)
+	if len(kv) != 2 {
+		return uploadErrorf("invalid provider config %q, must be key=value", raw)
+	}
+	if siteReq.Provider == nil {
+		siteReq.Provider = make(map[string]string)
+	}
+	siteReq.Provider[kv[0]] = kv[1]
+	return nil
+}
+
+// setProviderConfig records a new site's region and provider config in its stack config,
+// where every later operation on the site picks them up
+func setProviderConfig(ctx context.Context, s siteStack, region string, cfg map[string]string) error {
+	if region == "" {
+		region = defaultRegion
+	}
+	all := auto.ConfigMap{regionConfigKey: auto.ConfigValue{Value: region}}
+	for k, v := range cfg {
+		all[k] = auto.ConfigValue{Value: v}
+	}
+	return s.SetAllConfig(ctx, all)
+}
+
+// ensureRegion makes sure the stack knows which region its site was deployed to before running an
+// operation on it. sites record their region when they're created, and an operation without one
+// would run against whatever region the provider falls back to, so it fails rather than guess.
+func ensureRegion(ctx context.Context, s siteStack) error {
+	cfg, err := s.GetAllConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok := cfg[regionConfigKey]; !ok {
+		return fmt.Errorf("stack %q has no region in its config", s.Name())
+	}
+	return nil
+}
+
+// regionFrom reads the region from a stack's config. it's empty until the site's first
+// operation has recorded it.
+func regionFrom(cfg auto.ConfigMap) string {
+	return cfg[regionConfigKey].Value
+}
+
+func sortedRegions() []string {
+	regions := make([]string, 0, len(allowedRegions))
+	for r := range allowedRegions {
+		regions = append(regions, r)
+	}
+	sort.Strings(regions)
+	return regions
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optrefresh"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+// recoveryTracker remembers the stacks found with pending operations when the server started.
+// an update that is killed part way through leaves its in-flight resource operations recorded
+// as pending, and every later update fails until they're cleared.
+type recoveryTracker struct {
+	mu      sync.Mutex
+	pending map[string][]PendingOperation
+}
+
+var recoveries = &recoveryTracker{pending: make(map[string][]PendingOperation)}
+
+func (r *recoveryTracker) record(stackName string, ops []PendingOperation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending[stackName] = ops
+}
+
+func (r *recoveryTracker) forget(stackName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pending, stackName)
+}
+
+// forTenant returns the sites needing recovery that belong to the tenant
+func (r *recoveryTracker) forTenant(tenant string) []SiteRecoveryResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sites := []SiteRecoveryResponse{}
+	for stackName, ops := range r.pending {
+		if id, ok := siteIDFor(tenant, stackName); ok {
+			sites = append(sites, SiteRecoveryResponse{ID: id, PendingOperations: ops})
+		}
+	}
+	sort.Slice(sites, func(i, j int) bool { return sites[i].ID < sites[j].ID })
+	return sites
+}
+
+// findPendingOperations checks every stack for operations left pending by a previous run of the server
+func findPendingOperations() {
+	ctx := context.Background()
+	stacks, err := siteStacks.listStacks(ctx)
+	if err != nil {
+		fmt.Printf("recovery: failed to list stacks: %v\n", err)
+		return
+	}
+	for _, stack := range stacks {
+		if stack.UpdateInProgress || isDriftStack(stack.Name) {
+			continue
+		}
+		s, err := siteStacks.selectStack(ctx, stack.Name, nil)
+		if err != nil {
+			fmt.Printf("recovery: failed to select stack %q: %v\n", stack.Name, err)
+			continue
+		}
+		ops, err := pendingOperations(ctx, s)
+		if err != nil {
+			fmt.Printf("recovery: failed to check stack %q: %v\n", stack.Name, err)
+			continue
+		}
+		if len(ops) > 0 {
+			fmt.Printf("recovery: stack %q has %d pending operations, POST /sites/{id}/recover to clear them\n", stack.Name, len(ops))
+			recoveries.record(stack.Name, ops)
+		}
+	}
+}
+
+// pendingOperations reads the operations recorded as pending in the stack's state
+func pendingOperations(ctx context.Context, s siteStack) ([]PendingOperation, error) {
+	state, err := s.Export(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(state.Deployment) == 0 {
+		return nil, nil
+	}
+	var deployment apitype.DeploymentV3
+	if err := json.Unmarshal(state.Deployment, &deployment); err != nil {
+		return nil, fmt.Errorf("failed to read the state of stack %q: %w", s.Name(), err)
+	}
+	ops := []PendingOperation{}
+	for _, op := range deployment.PendingOperations {
+		ops = append(ops, PendingOperation{
+			URN:  string(op.Resource.URN),
+			Type: string(op.Resource.Type),
+			Op:   string(op.Type),
+		})
+	}
+	return ops, nil
+}
+
+// clearPendingOperations removes the pending operations from the stack's state, leaving the rest
+// of the deployment untouched
+func clearPendingOperations(ctx context.Context, s siteStack) error {
+	state, err := s.Export(ctx)
+	if err != nil {
+		return err
+	}
+	// work on the raw JSON so that nothing we don't know about is lost on the way back in
+	var deployment map[string]json.RawMessage
+	if err := json.Unmarshal(state.Deployment, &deployment); err != nil {
+		return fmt.Errorf("failed to read the state of stack %q: %w", s.Name(), err)
+	}
+	delete(deployment, "pending_operations")
+	state.Deployment, err = json.Marshal(deployment)
+	if err != nil {
+		return err
+	}
+	return s.Import(ctx, state)
+}
+
+// lists the sites that were left with pending operations when the server last stopped
+func listRecoveriesHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	response := &ListRecoveriesResponse{
+		Sites: recoveries.forTenant(callerFrom(req).Tenant),
+	}
+	json.NewEncoder(w).Encode(&response)
+}
+
+// shows the operations left pending in a site's state
+func getRecoveryHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := context.Background()
+	params := mux.Vars(req)
+	siteID := params["id"]
+	stackName := stackNameFor(req, siteID)
+
+	s, err := siteStacks.selectStack(ctx, stackName, nil)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	ops, err := pendingOperations(ctx, s)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+
+	response := &SiteRecoveryResponse{
+		ID:                siteID,
+		PendingOperations: ops,
+	}
+	json.NewEncoder(w).Encode(&response)
+}
+
+// clears the pending operations left behind by an interrupted update, then refreshes the site
+// so that its state picks up whatever those operations actually did
+func recoverHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := context.Background()
+	params := mux.Vars(req)
+	siteID := params["id"]
+	stackName := stackNameFor(req, siteID)
+
+	s, err := siteStacks.selectStack(ctx, stackName, nil)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	ops, err := pendingOperations(ctx, s)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	if len(ops) == 0 {
+		recoveries.forget(stackName)
+		writeErrorf(w, 409, codeConflict, siteID, "stack %q has no pending operations to recover from", siteID)
+		return
+	}
+	hooks, err := siteWebhooks(ctx, s)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+
+	op, err := operations.enqueue("recover", callerFrom(req).Tenant, siteID, hooks, func(ctx context.Context, op *operation) (*SiteResponse, error) {
+		if err := ensureRegion(ctx, s); err != nil {
+			return nil, err
+		}
+		if err := clearPendingOperations(ctx, s); err != nil {
+			return nil, err
+		}
+		recoveries.forget(stackName)
+
+		refreshRes, err := s.Refresh(ctx, optrefresh.ProgressStreams(os.Stdout), optrefresh.EventStreams(op.eventStream()))
+		if err != nil {
+			return nil, err
+		}
+		recordResourceChanges(op.kind, refreshRes.Summary)
+
+		outs, err := s.Outputs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		op.setOutputs(outs)
+		// a create that was interrupted may never have produced a URL
+		url, _ := outs["websiteUrl"].Value.(string)
+		return &SiteResponse{
+			ID:  siteID,
+			URL: url,
+		}, nil
+	})
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	writeAccepted(w, op)
+}
@@ -0,0 +1,1032 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+// the server under test. its stacks are kept in memory unless a test switches to fileStacks,
+// a file:// backend under a temporary directory.
+var (
+	testServer *httptest.Server
+	memStacks  *memStackManager
+	fileStacks *fileStackManager
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+func runTests(m *testing.M) int {
+	dir, err := ioutil.TempDir("", "pulumi_over_http")
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	stateDir := filepath.Join(dir, "state")
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fileStacks = newFileStackManager(stateDir)
+	memStacks = newMemStackManager()
+	siteStacks = memStacks
+	if contents, err = newContentStore(filepath.Join(dir, "content")); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if audit, err = openAuditStore(filepath.Join(dir, "audit.db")); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer audit.close()
+	webhooks = newWebhookDispatcher("", nil, 1, false)
+	operations = newOperationQueue(20, time.Hour)
+	idempotencyKeys = newIdempotencyStore(time.Hour)
+
+	handler, err := newHandler(newRouter(nil))
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	testServer = httptest.NewServer(handler)
+	defer testServer.Close()
+	return m.Run()
+}
+
+// useStacks has the server keep its stacks in m until the test finishes
+func useStacks(t *testing.T, m stackManager) {
+	siteStacks = m
+	t.Cleanup(func() { siteStacks = memStacks })
+}
+
+// request sends a request to the test server, encoding body as JSON unless it's a string
+func request(t *testing.T, method, path string, body interface{}, headers ...string) *http.Response {
+	t.Helper()
+	var r io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		r = strings.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, testServer.URL+path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// expect checks the response's status and decodes its body into out, if given
+func expect(t *testing.T, res *http.Response, status int, out interface{}) {
+	t.Helper()
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != status {
+		t.Fatalf("%s %s: got status %d, want %d: %s", res.Request.Method, res.Request.URL.Path, res.StatusCode, status, data)
+	}
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Fatalf("%s %s: failed to decode response: %v: %s", res.Request.Method, res.Request.URL.Path, err, data)
+		}
+	}
+}
+
+// expectError checks the response is an error with the given status and code
+func expectError(t *testing.T, res *http.Response, status int, code string) {
+	t.Helper()
+	var errRes ErrorResponse
+	expect(t, res, status, &errRes)
+	if errRes.Code != code {
+		t.Fatalf("%s %s: got error code %q, want %q", res.Request.Method, res.Request.URL.Path, errRes.Code, code)
+	}
+}
+
+// waitFor polls an operation until it finishes, failing the test unless it succeeded
+func waitFor(t *testing.T, op *OperationResponse) *OperationResponse {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Minute)
+	for op.FinishedAt == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("operation %s didn't finish in time", op.ID)
+		}
+		time.Sleep(200 * time.Millisecond)
+		path := "/operations/" + op.ID
+		op = &OperationResponse{}
+		expect(t, request(t, "GET", path, nil), 200, op)
+	}
+	if op.Status != OperationSucceeded {
+		t.Fatalf("operation %s (%s) failed: %+v", op.ID, op.Kind, op.Error)
+	}
+	return op
+}
+
+// failed checks the response started an operation and waits for it to fail
+func failed(t *testing.T, res *http.Response) *OperationResponse {
+	t.Helper()
+	op := &OperationResponse{}
+	expect(t, res, 202, op)
+	deadline := time.Now().Add(time.Minute)
+	for op.FinishedAt == nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("operation %s didn't finish in time", op.ID)
+		}
+		time.Sleep(50 * time.Millisecond)
+		path := "/operations/" + op.ID
+		op = &OperationResponse{}
+		expect(t, request(t, "GET", path, nil), 200, op)
+	}
+	if op.Status != OperationFailed || op.Error == nil {
+		t.Fatalf("expected operation %s (%s) to fail, got %+v", op.ID, op.Kind, op)
+	}
+	return op
+}
+
+// accepted checks the response started an operation and waits for it to succeed
+func accepted(t *testing.T, res *http.Response) *OperationResponse {
+	t.Helper()
+	var op OperationResponse
+	expect(t, res, 202, &op)
+	if loc := res.Header.Get("Location"); loc != "/operations/"+op.ID {
+		t.Fatalf("got Location %q for operation %s", loc, op.ID)
+	}
+	return waitFor(t, &op)
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	expect(t, request(t, "GET", "/openapi.json", nil), 200, &doc)
+	for key := range routeDocs {
+		parts := strings.SplitN(key, " ", 2)
+		if _, ok := doc.Paths[parts[1]][strings.ToLower(parts[0])]; !ok {
+			t.Errorf("the OpenAPI document is missing %s", key)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	expect(t, request(t, "GET", "/metrics", nil), 200, nil)
+}
+
+func TestHealthz(t *testing.T) {
+	var res HealthResponse
+	expect(t, request(t, "GET", "/healthz", nil), 200, &res)
+	if res.Status != "ok" {
+		t.Fatalf("unexpected health %+v", res)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	defer func(r *readinessChecker) { readiness = r }(readiness)
+	readiness = &readinessChecker{}
+	useStacks(t, fileStacks)
+	var res ReadinessResponse
+	expect(t, request(t, "GET", "/readyz", nil), 503, &res)
+	if res.Status != statusStarting {
+		t.Fatalf("expected the server to be starting before the first check, got %+v", res)
+	}
+
+	// the test backend doesn't have the aws plugin, so only the CLI and backend checks can pass
+	checked := readiness.check()
+	expect(t, request(t, "GET", "/readyz", nil), 503, &res)
+	if res.Status != statusNotReady || len(res.Checks) != 3 || len(checked.Checks) != 3 {
+		t.Fatalf("expected the result of 3 checks, got %+v", res)
+	}
+	cli, backend, plugins := res.Checks[0], res.Checks[1], res.Checks[2]
+	if _, err := exec.LookPath("pulumi"); err != nil {
+		if cli.Status != checkFailed || backend.Status != checkSkipped || plugins.Status != checkSkipped {
+			t.Fatalf("expected every check to fail without the pulumi CLI, got %+v", res.Checks)
+		}
+	} else if cli.Status != checkOK || backend.Status != checkOK || plugins.Status != checkFailed {
+		t.Fatalf("expected only the plugins check to fail, got %+v", res.Checks)
+	}
+
+	operations.mu.Lock()
+	operations.draining = true
+	operations.mu.Unlock()
+	defer func() {
+		operations.mu.Lock()
+		operations.draining = false
+		operations.mu.Unlock()
+	}()
+	expect(t, request(t, "GET", "/readyz", nil), 503, &res)
+	if res.Status != statusDraining {
+		t.Fatalf("expected the server to report that it's draining, got %+v", res)
+	}
+}
+
+func TestListTemplates(t *testing.T) {
+	var res ListTemplatesResponse
+	expect(t, request(t, "GET", "/templates", nil), 200, &res)
+	if len(res.Templates) != len(templates) {
+		t.Fatalf("got %d templates, want %d", len(res.Templates), len(templates))
+	}
+}
+
+func TestListWebhookFailures(t *testing.T) {
+	var res ListWebhookFailuresResponse
+	expect(t, request(t, "GET", "/webhooks/failures", nil), 200, &res)
+}
+
+func TestListRecoveries(t *testing.T) {
+	var res ListRecoveriesResponse
+	expect(t, request(t, "GET", "/recovery", nil), 200, &res)
+}
+
+func TestOperationNotFound(t *testing.T) {
+	expectError(t, request(t, "GET", "/operations/missing", nil), 404, codeNotFound)
+	expectError(t, request(t, "GET", "/sites/missing/operations/missing/events", nil), 404, codeNotFound)
+}
+
+// finished operations, and their events, are forgotten once they've been kept long enough
+func TestOperationRetention(t *testing.T) {
+	const id = "retained"
+	path := "/sites/" + id
+	op := accepted(t, request(t, "POST", "/sites", CreateSiteReq{ID: id, Content: "<h1>hi</h1>"}))
+	defer func() { accepted(t, request(t, "DELETE", path, nil)) }()
+	expect(t, request(t, "GET", "/operations/"+op.ID, nil), 200, nil)
+
+	operations.mu.Lock()
+	retention := operations.retention
+	operations.retention = time.Millisecond
+	operations.mu.Unlock()
+	defer func() {
+		operations.mu.Lock()
+		operations.retention = retention
+		operations.mu.Unlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	expectError(t, request(t, "GET", "/operations/"+op.ID, nil), 404, codeNotFound)
+	expectError(t, request(t, "GET", path+"/operations/"+op.ID+"/events", nil), 404, codeNotFound)
+	start(t, request(t, "PUT", path, UpdateSiteReq{Content: "<h1>again</h1>"}))
+	operations.mu.Lock()
+	_, kept := operations.ops[op.ID]
+	operations.mu.Unlock()
+	if kept {
+		t.Fatal("expected the next operation to drop the expired one")
+	}
+}
+
+// bad requests are turned away before any stack is touched
+func TestBadRequests(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+	}{
+		{"malformed JSON", "POST", "/sites", "{"},
+		{"unknown field", "POST", "/sites", map[string]interface{}{"id": "a", "content": "hi", "bogus": true}},
+		{"invalid id", "POST", "/sites", CreateSiteReq{ID: "not a valid id", Content: "hi"}},
+		{"missing content", "POST", "/sites", CreateSiteReq{ID: "a"}},
+		{"unknown template", "POST", "/sites", CreateSiteReq{ID: "a", Content: "hi", Template: "missing"}},
+		{"invalid ttl", "POST", "/sites", CreateSiteReq{ID: "a", Content: "hi", TTL: "soon"}},
+		{"disallowed region", "POST", "/sites", CreateSiteReq{ID: "a", Content: "hi", Region: "mars-east-1"}},
+		{"invalid webhook", "POST", "/sites", CreateSiteReq{ID: "a", Content: "hi", Webhooks: []string{"ftp://example.com"}}},
+		{"custom domains disabled", "POST", "/sites", CreateSiteReq{ID: "a", Content: "hi", Domain: "www.example.com"}},
+		{"domain change", "PUT", "/sites/a", map[string]interface{}{"content": "hi", "domain": "www.example.com"}},
+		{"region change", "PUT", "/sites/a", map[string]interface{}{"content": "hi", "region": "us-west-2"}},
+		{"missing ttl", "PATCH", "/sites/a", map[string]interface{}{}},
+		{"missing version", "POST", "/sites/a/rollback", nil},
+		{"invalid page size", "GET", "/sites/a/history?pageSize=x", nil},
+		{"invalid limit", "GET", "/sites?limit=-1", nil},
+		{"invalid audit limit", "GET", "/audit?limit=x", nil},
+		{"invalid state", "PUT", "/sites/a/state", map[string]interface{}{"version": 3, "deployment": map[string]interface{}{"resources": []interface{}{map[string]interface{}{}}}}},
+		{"state from another stack", "PUT", "/sites/a/state", SiteState{Version: 3, Deployment: json.RawMessage(`{
+			"manifest": {"time": "2021-04-20T00:00:00Z", "magic": "", "version": "v3.0.0"},
+			"resources": [{"urn": "urn:pulumi:b::pulumi_over_http::pulumi:pulumi:Stack::pulumi_over_http-b", "type": "pulumi:pulumi:Stack", "custom": false}]
+		}`)}},
+		{"invalid clone id", "POST", "/sites/a/clone", CloneSiteReq{ID: "not a valid id"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expectError(t, request(t, tt.method, tt.path, tt.body), 400, codeBadRequest)
+		})
+	}
+
+	// the fields sent with uploads are held to the same schemas as JSON bodies
+	uploads := []struct {
+		name   string
+		method string
+		path   string
+		fields map[string]string
+	}{
+		{"invalid id", "POST", "/sites", map[string]string{"id": "not a valid id"}},
+		{"missing id", "POST", "/sites", nil},
+		{"invalid args", "POST", "/sites", map[string]string{"id": "a", "args": "[1]"}},
+		{"create field on update", "PUT", "/sites/a", map[string]string{"ttl": "1h"}},
+	}
+	for _, tt := range uploads {
+		t.Run("multipart "+tt.name, func(t *testing.T) {
+			body, contentType := multipartUpload(t, tt.fields)
+			expectError(t, request(t, tt.method, tt.path, body, "Content-Type", contentType), 400, codeBadRequest)
+		})
+		t.Run("tarball "+tt.name, func(t *testing.T) {
+			query := make([]string, 0, len(tt.fields))
+			for k, v := range tt.fields {
+				query = append(query, k+"="+url.QueryEscape(v))
+			}
+			path := tt.path + "?" + strings.Join(query, "&")
+			expectError(t, request(t, tt.method, path, tarballUpload(t), "Content-Type", "application/gzip"), 400, codeBadRequest)
+		})
+	}
+}
+
+// multipartUpload builds a multipart upload of an index page along with the form fields
+func multipartUpload(t *testing.T, fields map[string]string) (string, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fw, err := mw.CreateFormFile("file", "index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(fw, "<h1>hi</h1>")
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String(), mw.FormDataContentType()
+}
+
+// tarballUpload builds a gzipped tarball holding an index page
+func tarballUpload(t *testing.T) string {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	index := []byte("<h1>hi</h1>")
+	if err := tw.WriteHeader(&tar.Header{Name: "index.html", Mode: 0644, Size: int64(len(index)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(index)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// sites built from templates that ignore content can be created and updated without any
+// update bodies written before the schema, which repeat the site's ID, are still accepted
+func TestUpdateWithID(t *testing.T) {
+	const id = "updated-with-id"
+	path := "/sites/" + id
+	accepted(t, request(t, "POST", "/sites", CreateSiteReq{ID: id, Content: "v1"}))
+	defer func() { accepted(t, request(t, "DELETE", path, nil)) }()
+	accepted(t, request(t, "PUT", path, `{"id":"`+id+`","content":"v2"}`))
+	if got := deployedContent(t, id); len(got) != 2 || got[1] != "v2" {
+		t.Fatalf("expected the update to deploy its content, got %q", got)
+	}
+}
+
+func TestSiteWithoutContent(t *testing.T) {
+	const id = "redirecting"
+	path := "/sites/" + id
+	accepted(t, request(t, "POST", "/sites", CreateSiteReq{ID: id, Template: "redirect-only", Args: json.RawMessage(`{"hostName":"example.com"}`)}))
+	defer func() { accepted(t, request(t, "DELETE", path, nil)) }()
+	accepted(t, request(t, "PUT", path, UpdateSiteReq{Args: json.RawMessage(`{"hostName":"example.org"}`)}))
+}
+
+func TestAuditLog(t *testing.T) {
+	expectError(t, request(t, "POST", "/sites", "{"), 400, codeBadRequest)
+
+	var res ListAuditResponse
+	expect(t, request(t, "GET", "/audit?limit=1", nil), 200, &res)
+	if len(res.Records) != 1 || res.Records[0].Method != "POST" {
+		t.Fatalf("expected the rejected request to be audited, got %+v", res.Records)
+	}
+}
+
+// the audit log only reads so much of a body the handler left unread to hash it
+func TestAuditBodyHash(t *testing.T) {
+	body := &hashingReader{r: ioutil.NopCloser(strings.NewReader("hi")), h: sha256.New()}
+	if sum, ok := body.sum(); !ok || sum != "8f434346648f6b96df89dda901c5176b10a6d83961dd3c1ac88b59b2dc327aa4" {
+		t.Fatalf("expected the unread body to be hashed, got %q", sum)
+	}
+
+	large := strings.NewReader(strings.Repeat("x", int(2*maxAuditDrainBytes)))
+	body = &hashingReader{r: ioutil.NopCloser(large), h: sha256.New()}
+	if sum, ok := body.sum(); ok {
+		t.Fatalf("expected a large unread body not to be hashed, got %q", sum)
+	}
+	if read := 2*maxAuditDrainBytes - int64(large.Len()); read > maxAuditDrainBytes+1 {
+		t.Fatalf("expected at most %d bytes to be read, got %d", maxAuditDrainBytes+1, read)
+	}
+}
+
+func TestSiteNotFound(t *testing.T) {
+	update := UpdateSiteReq{Content: "hi"}
+	tests := []struct {
+		method string
+		path   string
+		body   interface{}
+	}{
+		{"GET", "/sites/missing", nil},
+		{"PUT", "/sites/missing", update},
+		{"PATCH", "/sites/missing", map[string]string{"ttl": "1h"}},
+		{"DELETE", "/sites/missing", nil},
+		{"POST", "/sites/missing/preview", update},
+		{"POST", "/sites/missing/refresh", nil},
+		{"GET", "/sites/missing/drift", nil},
+		{"GET", "/sites/missing/history", nil},
+		{"POST", "/sites/missing/rollback?version=1", nil},
+		{"GET", "/sites/missing/recovery", nil},
+		{"POST", "/sites/missing/recover", nil},
+		{"GET", "/sites/missing/state", nil},
+		{"PUT", "/sites/missing/state", SiteState{Version: 3, Deployment: json.RawMessage(`{"manifest": {"time": "2021-04-20T00:00:00Z", "magic": "", "version": "v3.0.0"}}`)}},
+		{"POST", "/sites/missing/clone", CloneSiteReq{ID: "copy"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			expectError(t, request(t, tt.method, tt.path, tt.body), 404, codeNotFound)
+		})
+	}
+}
+
+func TestSiteLifecycle(t *testing.T) {
+	requirePulumi(t)
+	useStacks(t, fileStacks)
+	const id = "lifecycle"
+	path := "/sites/" + id
+
+	create := CreateSiteReq{ID: id, Content: "<h1>v1</h1>", Tags: map[string]string{"team": "web"}}
+	op := accepted(t, request(t, "POST", "/sites", create))
+	if op.Site == nil || op.Site.URL == "" {
+		t.Fatalf("expected the create to report the site's URL, got %+v", op.Site)
+	}
+	expectError(t, request(t, "POST", "/sites", create), 409, codeConflict)
+
+	var site SiteResponse
+	res := request(t, "GET", path, nil)
+	etag := res.Header.Get("ETag")
+	expect(t, res, 200, &site)
+	if site.URL != op.Site.URL || site.Tags["team"] != "web" || site.Region != defaultRegion {
+		t.Fatalf("unexpected site %+v", site)
+	}
+
+	var list ListSitesResponse
+	expect(t, request(t, "GET", "/sites?tag=team%3Dweb&expand=summary", nil), 200, &list)
+	if len(list.IDs) != 1 || list.IDs[0] != id || len(list.Sites) != 1 {
+		t.Fatalf("expected to list only %q, got %+v", id, list)
+	}
+	expect(t, request(t, "GET", "/sites?tag=team%3Dother", nil), 200, &list)
+	if len(list.IDs) != 0 {
+		t.Fatalf("expected no sites tagged team=other, got %v", list.IDs)
+	}
+
+	var preview PreviewSiteResponse
+	expect(t, request(t, "POST", path+"/preview", UpdateSiteReq{Content: "<h1>v2</h1>"}), 200, &preview)
+
+	update := UpdateSiteReq{Content: "<h1>v2</h1>"}
+	expectError(t, request(t, "PUT", path, update, "If-Match", `"999"`), 412, codePreconditionFailed)
+	accepted(t, request(t, "PUT", path, update, "If-Match", etag))
+
+	var history SiteHistoryResponse
+	expect(t, request(t, "GET", path+"/history", nil), 200, &history)
+	if len(history.Updates) != 2 {
+		t.Fatalf("expected 2 updates, got %+v", history.Updates)
+	}
+	expectError(t, request(t, "POST", path+"/rollback?version=99", nil), 404, codeNotFound)
+	accepted(t, request(t, "POST", path+"/rollback?version=1", nil))
+
+	expect(t, request(t, "PATCH", path, map[string]string{"ttl": "1h"}), 200, &site)
+	if site.ExpiresAt == nil || time.Until(*site.ExpiresAt) > time.Hour {
+		t.Fatalf("expected the site to expire within the hour, got %v", site.ExpiresAt)
+	}
+	expect(t, request(t, "PATCH", path, map[string]string{"ttl": ""}), 200, &site)
+	if site.ExpiresAt != nil {
+		t.Fatalf("expected the expiry to be removed, got %v", site.ExpiresAt)
+	}
+
+	refresh := accepted(t, request(t, "POST", path+"/refresh", nil))
+	events := request(t, "GET", path+"/operations/"+refresh.ID+"/events", nil)
+	defer events.Body.Close()
+	stream, err := ioutil.ReadAll(events.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(stream), "event: done") {
+		t.Fatalf("expected the event stream to end with the operation, got %s", stream)
+	}
+
+	var drift DriftResponse
+	expect(t, request(t, "GET", path+"/drift", nil), 200, &drift)
+	if drift.Drifted || drift.Error != "" {
+		t.Fatalf("expected no drift, got %+v", drift)
+	}
+
+	var recovery SiteRecoveryResponse
+	expect(t, request(t, "GET", path+"/recovery", nil), 200, &recovery)
+	if len(recovery.PendingOperations) != 0 {
+		t.Fatalf("expected no pending operations, got %+v", recovery.PendingOperations)
+	}
+	expectError(t, request(t, "POST", path+"/recover", nil), 409, codeConflict)
+
+	var state SiteState
+	res = request(t, "GET", path+"/state", nil)
+	etag = res.Header.Get("ETag")
+	expect(t, res, 200, &state)
+	if state.Version != 3 || !strings.Contains(string(state.Deployment), "urn:pulumi:"+id+"::") {
+		t.Fatalf("unexpected state %s", state.Deployment)
+	}
+	expectError(t, request(t, "PUT", path+"/state", state, "If-Match", `"999"`), 412, codePreconditionFailed)
+	expect(t, request(t, "PUT", path+"/state", state, "If-Match", etag), 200, &site)
+	if site.URL != op.Site.URL {
+		t.Fatalf("expected the imported state to keep the site's URL, got %+v", site)
+	}
+
+	// the clone adopts the original's resources, and its settings, rather than creating its own
+	clone := CloneSiteReq{ID: id + "-clone"}
+	res = request(t, "POST", path+"/clone", clone)
+	if loc := res.Header.Get("Location"); loc != "/sites/"+clone.ID {
+		t.Fatalf("got Location %q for the clone", loc)
+	}
+	expect(t, res, 201, &site)
+	if site.ID != clone.ID || site.URL != op.Site.URL || site.Tags["team"] != "web" {
+		t.Fatalf("unexpected clone %+v", site)
+	}
+	expectError(t, request(t, "POST", path+"/clone", clone), 409, codeConflict)
+	accepted(t, request(t, "PUT", "/sites/"+clone.ID, UpdateSiteReq{Content: "<h1>clone</h1>"}))
+	accepted(t, request(t, "DELETE", "/sites/"+clone.ID, nil))
+
+	accepted(t, request(t, "DELETE", path, nil))
+	expectError(t, request(t, "GET", path, nil), 404, codeNotFound)
+}
+
+// a site's region, tags, and expiry are kept in its stack's config and outlive each operation
+func TestSiteSettingsRoundTrip(t *testing.T) {
+	allowedRegions["eu-west-1"] = true
+	defer delete(allowedRegions, "eu-west-1")
+	const id = "roundtrip"
+	path := "/sites/" + id
+
+	create := CreateSiteReq{ID: id, Content: "<h1>v1</h1>", Region: "eu-west-1", Tags: map[string]string{"team": "web"}, TTL: "1h"}
+	accepted(t, request(t, "POST", "/sites", create))
+	check := func() {
+		t.Helper()
+		var site SiteResponse
+		expect(t, request(t, "GET", path, nil), 200, &site)
+		if site.Region != "eu-west-1" || site.Tags["team"] != "web" {
+			t.Fatalf("expected the site's region and tags to be kept, got %+v", site)
+		}
+		if site.ExpiresAt == nil || time.Until(*site.ExpiresAt) > time.Hour {
+			t.Fatalf("expected the site to expire within the hour, got %v", site.ExpiresAt)
+		}
+	}
+	check()
+	accepted(t, request(t, "PUT", path, UpdateSiteReq{Content: "<h1>v2</h1>"}))
+	check()
+
+	// an empty set of tags clears them
+	accepted(t, request(t, "PUT", path, UpdateSiteReq{Content: "<h1>v3</h1>", Tags: &map[string]string{}}))
+	var site SiteResponse
+	expect(t, request(t, "GET", path, nil), 200, &site)
+	if len(site.Tags) != 0 {
+		t.Fatalf("expected the tags to be removed, got %+v", site.Tags)
+	}
+	accepted(t, request(t, "DELETE", path, nil))
+	expectError(t, request(t, "GET", path, nil), 404, codeNotFound)
+}
+
+// operations on a site that has lost its region fail rather than run against the wrong one
+func TestMissingRegion(t *testing.T) {
+	ctx := context.Background()
+	s, err := memStacks.newStack(ctx, "noregion", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer memStacks.removeStack(ctx, "noregion")
+	if err := (&siteSettings{Template: defaultTemplate, Content: &siteContent{Index: "hi"}}).save(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+
+	var site SiteResponse
+	expect(t, request(t, "GET", "/sites/noregion", nil), 200, &site)
+	if site.Region != "" {
+		t.Fatalf("expected no region to be reported, got %q", site.Region)
+	}
+	// operations only look for the region once they run, after any queued create has recorded it
+	for _, route := range []string{"PUT /sites/noregion", "POST /sites/noregion/refresh", "DELETE /sites/noregion"} {
+		parts := strings.SplitN(route, " ", 2)
+		var body interface{}
+		if parts[0] == "PUT" {
+			body = UpdateSiteReq{Content: "<h1>v2</h1>"}
+		}
+		op := failed(t, request(t, parts[0], parts[1], body))
+		if op.Error.Code != codeInternal {
+			t.Fatalf("%s: expected the operation to fail for want of a region, got %+v", route, op.Error)
+		}
+	}
+}
+
+// sites whose TTL runs out are destroyed by the reaper, whether the TTL was set when the site
+// was created or patched on later
+func TestReapExpiredSites(t *testing.T) {
+	accepted(t, request(t, "POST", "/sites", CreateSiteReq{ID: "expiring", Content: "<h1>hi</h1>", TTL: "1ms"}))
+	accepted(t, request(t, "POST", "/sites", CreateSiteReq{ID: "patched", Content: "<h1>hi</h1>"}))
+	accepted(t, request(t, "POST", "/sites", CreateSiteReq{ID: "lasting", Content: "<h1>hi</h1>", TTL: "1h"}))
+	defer func() { accepted(t, request(t, "DELETE", "/sites/lasting", nil)) }()
+
+	var site SiteResponse
+	expect(t, request(t, "PATCH", "/sites/patched", map[string]string{"ttl": "1ms"}), 200, &site)
+	if site.ExpiresAt == nil {
+		t.Fatal("expected the patched site to have an expiry")
+	}
+	time.Sleep(time.Second)
+
+	reapExpiredSites()
+	for _, id := range []string{"expiring", "patched"} {
+		reaping.Lock()
+		op, ok := reaping.ops[id]
+		reaping.Unlock()
+		if !ok {
+			t.Fatalf("expected site %q to be reaped", id)
+		}
+		waitFor(t, op.response())
+		expectError(t, request(t, "GET", "/sites/"+id, nil), 404, codeNotFound)
+	}
+	if reaping.busy("lasting") {
+		t.Fatal("expected the site that hasn't expired to be left alone")
+	}
+	expect(t, request(t, "GET", "/sites/lasting", nil), 200, &site)
+}
+
+func TestListSitesByTag(t *testing.T) {
+	sites := map[string]map[string]string{
+		"tagged-a": {"team": "web"},
+		"tagged-b": {"team": "ops"},
+		"tagged-c": nil,
+	}
+	for id, tags := range sites {
+		accepted(t, request(t, "POST", "/sites", CreateSiteReq{ID: id, Content: "<h1>hi</h1>", Tags: tags}))
+		defer func(id string) { accepted(t, request(t, "DELETE", "/sites/"+id, nil)) }(id)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"tag=team%3Dweb", []string{"tagged-a"}},
+		{"tag=team", []string{"tagged-a", "tagged-b"}},
+		{"tag=team%3Dother", []string{}},
+		{"", []string{"tagged-a", "tagged-b", "tagged-c"}},
+	}
+	for _, tt := range tests {
+		var list ListSitesResponse
+		expect(t, request(t, "GET", "/sites?prefix=tagged-&expand=summary&"+tt.query, nil), 200, &list)
+		if strings.Join(list.IDs, ",") != strings.Join(tt.want, ",") || len(list.Sites) != len(tt.want) {
+			t.Errorf("?%s: got %v, want %v", tt.query, list.IDs, tt.want)
+		}
+	}
+
+	var site SiteResponse
+	expect(t, request(t, "GET", "/sites/tagged-a", nil), 200, &site)
+	if site.Tags["team"] != "web" {
+		t.Fatalf("expected the site's tags, got %+v", site)
+	}
+}
+
+// holdStack takes a site's place in line, so that operations on it queue up behind the test
+// until the returned function is called
+func holdStack(t *testing.T, stackName string) func() {
+	t.Helper()
+	ticket, err := stackLocks.lock(context.Background(), stackName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ticket.release
+}
+
+// start checks the response started an operation without waiting for it
+func start(t *testing.T, res *http.Response) *OperationResponse {
+	t.Helper()
+	var op OperationResponse
+	expect(t, res, 202, &op)
+	return &op
+}
+
+// deployedContent reads the content recorded by each of a stack's updates, oldest first
+func deployedContent(t *testing.T, stackName string) []string {
+	t.Helper()
+	var deployed []string
+	history := memStacks.state(t, stackName).history
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Kind != "update" {
+			continue
+		}
+		settings, err := siteSettingsFrom(history[i].Config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deployed = append(deployed, settings.Content.Index)
+	}
+	return deployed
+}
+
+// each queued update deploys its own settings, on top of the updates queued ahead of it
+func TestQueuedUpdates(t *testing.T) {
+	const id = "queued"
+	path := "/sites/" + id
+	accepted(t, request(t, "POST", "/sites", CreateSiteReq{ID: id, Content: "v1"}))
+	defer func() { accepted(t, request(t, "DELETE", path, nil)) }()
+
+	release := holdStack(t, id)
+	first := start(t, request(t, "PUT", path, UpdateSiteReq{Content: "v2", Tags: &map[string]string{"v": "2"}}))
+	second := start(t, request(t, "PUT", path, UpdateSiteReq{Content: "v3"}))
+	release()
+	waitFor(t, first)
+	waitFor(t, second)
+
+	if got := strings.Join(deployedContent(t, id), ","); got != "v1,v2,v3" {
+		t.Fatalf("expected each update to deploy its own content, got %s", got)
+	}
+	var site SiteResponse
+	expect(t, request(t, "GET", path, nil), 200, &site)
+	if site.Tags["v"] != "2" {
+		t.Fatalf("expected the second update to keep the tags set by the first, got %+v", site.Tags)
+	}
+}
+
+// previews don't wait behind a site's operations, since the caller is waiting for them
+func TestPreviewBusySite(t *testing.T) {
+	const id = "previewed"
+	path := "/sites/" + id
+	accepted(t, request(t, "POST", "/sites", CreateSiteReq{ID: id, Content: "v1"}))
+	defer func() { accepted(t, request(t, "DELETE", path, nil)) }()
+
+	release := holdStack(t, id)
+	expectError(t, request(t, "POST", path+"/preview", UpdateSiteReq{Content: "v2"}), 409, codeConflict)
+	release()
+
+	var preview PreviewSiteResponse
+	expect(t, request(t, "POST", path+"/preview", UpdateSiteReq{Content: "v2"}), 200, &preview)
+}
+
+// a clone copies the original's state and config into a new stack, without deploying anything
+func TestCloneSite(t *testing.T) {
+	const id, cloneID = "cloned", "cloned-copy"
+	path := "/sites/" + id
+	accepted(t, request(t, "POST", "/sites", CreateSiteReq{ID: id, Content: "<h1>hi</h1>", TTL: "1h", Tags: map[string]string{"team": "web"}}))
+	defer func() { accepted(t, request(t, "DELETE", path, nil)) }()
+	original := memStacks.state(t, id)
+
+	var site SiteResponse
+	expect(t, request(t, "POST", path+"/clone", CloneSiteReq{ID: cloneID}), 201, &site)
+	if site.ID != cloneID || site.Tags["team"] != "web" || site.ExpiresAt != nil {
+		t.Fatalf("expected the clone to keep the original's tags but not its TTL, got %+v", site)
+	}
+	clone := memStacks.state(t, cloneID)
+	if len(clone.history) != 0 {
+		t.Fatalf("expected the clone's state to be imported rather than deployed, got %d updates", len(clone.history))
+	}
+	resources := memResources(clone.deployment)
+	if len(resources) != len(memResources(original.deployment)) {
+		t.Fatalf("expected the clone to have the original's %d resources, got %d", len(memResources(original.deployment)), len(resources))
+	}
+	for _, res := range resources {
+		if !strings.HasPrefix(string(res.URN), "urn:pulumi:"+cloneID+"::") {
+			t.Fatalf("expected the clone's URNs to be renamed for its stack, got %s", res.URN)
+		}
+	}
+	for k, v := range original.config {
+		if k != project+":"+expiresAtConfigKey && clone.config[k] != v {
+			t.Fatalf("expected the clone to have the original's config, got %v, want %v", clone.config, original.config)
+		}
+	}
+	if _, ok := clone.config[project+":"+expiresAtConfigKey]; ok {
+		t.Fatal("expected the clone not to inherit the original's TTL")
+	}
+	if got := len(memStacks.state(t, id).history); got != len(original.history) {
+		t.Fatalf("expected the clone to leave the original's history alone, got %d updates, want %d", got, len(original.history))
+	}
+	expectError(t, request(t, "POST", path+"/clone", CloneSiteReq{ID: cloneID}), 409, codeConflict)
+
+	// the clone's stack is removed by hand, since destroying it would destroy the original's
+	// resources too
+	memStacks.mu.Lock()
+	delete(memStacks.stacks, cloneID)
+	memStacks.mu.Unlock()
+}
+
+// importing state with a stale ETag fails without waiting for the site's queued operations
+func TestImportStateStaleETag(t *testing.T) {
+	const id = "imported"
+	path := "/sites/" + id
+	accepted(t, request(t, "POST", "/sites", CreateSiteReq{ID: id, Content: "<h1>hi</h1>"}))
+	defer func() { accepted(t, request(t, "DELETE", path, nil)) }()
+	var state SiteState
+	expect(t, request(t, "GET", path+"/state", nil), 200, &state)
+
+	release := holdStack(t, id)
+	defer release()
+	expectError(t, request(t, "PUT", path+"/state", state, "If-Match", `"999"`), 412, codePreconditionFailed)
+}
+
+// a site whose first deployment failed has no URL to report, which mustn't bring down the worker
+func TestSiteFromMissingOutputs(t *testing.T) {
+	site := siteFromOutputs("a", auto.OutputMap{})
+	if site.ID != "a" || site.URL != "" {
+		t.Fatalf("unexpected site %+v", site)
+	}
+}
+
+// a drift check reports resources changed outside of Pulumi without touching the site's own
+// stack, so the site's history and ETag stay as they were
+func TestDriftCheck(t *testing.T) {
+	const id = "drifting"
+	path := "/sites/" + id
+	accepted(t, request(t, "POST", "/sites", CreateSiteReq{ID: id, Content: "<h1>hi</h1>"}))
+	defer func() { accepted(t, request(t, "DELETE", path, nil)) }()
+
+	res := request(t, "GET", path, nil)
+	etag := res.Header.Get("ETag")
+	expect(t, res, 200, nil)
+	history := len(memStacks.state(t, id).history)
+
+	var drift DriftResponse
+	expect(t, request(t, "GET", path+"/drift", nil), 200, &drift)
+	if drift.Drifted {
+		t.Fatalf("expected no drift before the bucket was changed, got %+v", drift)
+	}
+	memStacks.change(t, "site-bucket")
+	expect(t, request(t, "GET", path+"/drift", nil), 200, &drift)
+	if len(drift.Resources) != 1 || drift.Resources[0].Type != "aws:s3/bucket:Bucket" || drift.Resources[0].Op != "update" {
+		t.Fatalf("expected the bucket to have drifted, got %+v", drift)
+	}
+
+	// rather than wait behind the site's operations, a check fails fast
+	release := holdStack(t, id)
+	expectError(t, request(t, "GET", path+"/drift", nil), 409, codeConflict)
+	release()
+
+	// the scheduler's checks run as operations, which report the drift too
+	op, err := enqueueDriftCheck("", id, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finished := waitFor(t, op.response())
+	if finished.Kind != "drift" || finished.Site == nil || finished.Site.Drift == nil || !finished.Site.Drift.Drifted {
+		t.Fatalf("expected the operation to report the drift, got %+v", finished)
+	}
+
+	res = request(t, "GET", path, nil)
+	if got := res.Header.Get("ETag"); got != etag {
+		t.Fatalf("expected the drift check to leave the ETag alone, got %s, want %s", got, etag)
+	}
+	var site SiteResponse
+	expect(t, res, 200, &site)
+	if site.Drift == nil || !site.Drift.Drifted {
+		t.Fatalf("expected the site to report the drift, got %+v", site.Drift)
+	}
+	if got := len(memStacks.state(t, id).history); got != history {
+		t.Fatalf("expected the drift check to leave the site's history alone, got %d updates, want %d", got, history)
+	}
+	stacks, err := memStacks.listStacks(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stack := range stacks {
+		if isDriftStack(stack.Name) {
+			t.Fatalf("expected the scratch stack %q to be removed", stack.Name)
+		}
+	}
+}
+
+// a queued create only writes the site's config once it's its turn, and a PATCH waits for the
+// create rather than changing the config underneath it
+func TestQueuedConfigChanges(t *testing.T) {
+	const id = "queued-config"
+	path := "/sites/" + id
+	release := holdStack(t, id)
+	created := start(t, request(t, "POST", "/sites", CreateSiteReq{ID: id, Content: "v1", Tags: map[string]string{"v": "1"}}))
+	defer func() { accepted(t, request(t, "DELETE", path, nil)) }()
+	// releasing a ticket twice is harmless, and a failure mustn't leave the delete waiting
+	defer release()
+	if cfg := memStacks.state(t, id).config; len(cfg) != 0 {
+		t.Fatalf("expected the create not to write any config before its turn, got %v", cfg)
+	}
+
+	patched := make(chan *http.Response, 1)
+	go func() { patched <- request(t, "PATCH", path, map[string]string{"ttl": "1h"}) }()
+	select {
+	case res := <-patched:
+		t.Fatalf("expected the PATCH to wait for the queued create, got %d", res.StatusCode)
+	case <-time.After(100 * time.Millisecond):
+	}
+	release()
+	waitFor(t, created)
+
+	var site SiteResponse
+	expect(t, <-patched, 200, &site)
+	if site.ExpiresAt == nil || site.Tags["v"] != "1" {
+		t.Fatalf("expected the site to keep both the create's tags and the PATCH's expiry, got %+v", site)
+	}
+}
+
+// a rollback queued behind an update redeploys the old content once the update is done, keeping
+// the tags the update set
+func TestQueuedRollback(t *testing.T) {
+	const id = "queued-rollback"
+	path := "/sites/" + id
+	accepted(t, request(t, "POST", "/sites", CreateSiteReq{ID: id, Content: "v1"}))
+	defer func() { accepted(t, request(t, "DELETE", path, nil)) }()
+
+	release := holdStack(t, id)
+	update := start(t, request(t, "PUT", path, UpdateSiteReq{Content: "v2", Tags: &map[string]string{"v": "2"}}))
+	rollback := start(t, request(t, "POST", path+"/rollback?version=1", nil))
+	release()
+	waitFor(t, update)
+	waitFor(t, rollback)
+
+	if got := strings.Join(deployedContent(t, id), ","); got != "v1,v2,v1" {
+		t.Fatalf("expected the rollback to redeploy the first version's content, got %s", got)
+	}
+	var site SiteResponse
+	expect(t, request(t, "GET", path, nil), 200, &site)
+	if site.Tags["v"] != "2" {
+		t.Fatalf("expected the rollback to keep the update's tags, got %+v", site.Tags)
+	}
+}
+
+// commands that fail before the Automation API tails the engine's log never have their event
+// streams closed, and mustn't leave the site's operations waiting on them
+func TestCommandFailsBeforeStreaming(t *testing.T) {
+	const id = "unselectable"
+	path := "/sites/" + id
+	accepted(t, request(t, "POST", "/sites", CreateSiteReq{ID: id, Content: "<h1>hi</h1>"}))
+	defer func() { accepted(t, request(t, "DELETE", path, nil)) }()
+
+	t.Run("operations", func(t *testing.T) {
+		memStacks.breakStack(t, id)
+		failed(t, request(t, "PUT", path, UpdateSiteReq{Content: "<h1>again</h1>"}))
+		failed(t, request(t, "POST", path+"/refresh", nil))
+		failed(t, request(t, "DELETE", path, nil))
+	})
+	t.Run("preview", func(t *testing.T) {
+		memStacks.breakStack(t, id)
+		expectError(t, request(t, "POST", path+"/preview", UpdateSiteReq{Content: "<h1>again</h1>"}), 500, codeInternal)
+	})
+	t.Run("drift", func(t *testing.T) {
+		memStacks.breakStack(t, id+driftStackSuffix)
+		expectError(t, request(t, "GET", path+"/drift", nil), 500, codeInternal)
+		op, err := enqueueDriftCheck("", id, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitUntil(t, func() bool { return op.response().FinishedAt != nil })
+		if res := op.response(); res.Status != OperationFailed {
+			t.Fatalf("expected the drift check to fail, got %+v", res)
+		}
+	})
+	// the failed preview and drift checks let go of the site
+	accepted(t, request(t, "PUT", path, UpdateSiteReq{Content: "<h1>again</h1>"}))
+}
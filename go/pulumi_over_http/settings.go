@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// config keys that record how a site was deployed
+const (
+	contentHashConfigKey  = "contentHash"
+	templateConfigKey     = "template"
+	templateArgsConfigKey = "templateArgs"
+	webhooksConfigKey     = "webhooks"
+	tagsConfigKey         = "tags"
+	// older versions recorded the content itself rather than a hash pointing into the content store
+	legacyContentConfigKey = "content"
+)
+
+// errNoRecordedContent is returned for updates that didn't record the content they deployed
+var errNoRecordedContent = errors.New("no content was recorded")
+
+// siteSettings is everything needed to rebuild the program for a site. the settings are recorded
+// in stack config with each update, and the config used for an update is saved with it in the
+// stack's history, which lets us redeploy a site exactly as it was at any version.
+type siteSettings struct {
+	Template string
+	Args     json.RawMessage
+	Content  *siteContent
+	// Webhooks are notified when an operation on the site finishes
+	Webhooks []string
+	Tags     map[string]string
+	// Domain is the custom domain the site is served from, if it has one. it's set when the site
+	// is created and never changes.
+	Domain *customDomain
+}
+
+// program builds the pulumi program for the site from its template
+func (ss *siteSettings) program() (pulumi.RunFunc, error) {
+	t, ok := templates[ss.Template]
+	if !ok {
+		return nil, fmt.Errorf("unknown template %q", ss.Template)
+	}
+	content := ss.Content
+	if content == nil {
+		content = &siteContent{}
+	}
+	return t.newProgram(ss.Args, content, ss.Domain)
+}
+
+// save stores the content and records the settings in stack config so that the next update
+// carries them into the history. the args are base64 encoded so they survive `pulumi config set`.
+func (ss *siteSettings) save(ctx context.Context, s siteStack) error {
+	hash, err := contents.put(ss.Content)
+	if err != nil {
+		return fmt.Errorf("failed to store site content: %w", err)
+	}
+	hooks, err := json.Marshal(ss.Webhooks)
+	if err != nil {
+		return err
+	}
+	tags, err := json.Marshal(ss.Tags)
+	if err != nil {
+		return err
+	}
+	cfg := auto.ConfigMap{
+		contentHashConfigKey:  auto.ConfigValue{Value: hash},
+		templateConfigKey:     auto.ConfigValue{Value: ss.Template},
+		templateArgsConfigKey: auto.ConfigValue{Value: base64.StdEncoding.EncodeToString(ss.Args)},
+		webhooksConfigKey:     auto.ConfigValue{Value: base64.StdEncoding.EncodeToString(hooks)},
+		tagsConfigKey:         auto.ConfigValue{Value: base64.StdEncoding.EncodeToString(tags)},
+	}
+	if ss.Domain != nil {
+		cfg[domainConfigKey] = auto.ConfigValue{Value: ss.Domain.Name}
+		cfg[domainZoneConfigKey] = auto.ConfigValue{Value: ss.Domain.Zone}
+	}
+	return s.SetAllConfig(ctx, cfg)
+}
+
+// hasRecordedContent reports whether the config of an update says what content it deployed
+func hasRecordedContent(cfg auto.ConfigMap) bool {
+	_, hasHash := cfg[project+":"+contentHashConfigKey]
+	_, hasLegacy := cfg[project+":"+legacyContentConfigKey]
+	return hasHash || hasLegacy
+}
+
+// siteSettingsFrom reads back the settings recorded in the config of an update
+func siteSettingsFrom(cfg auto.ConfigMap) (*siteSettings, error) {
+	// sites deployed before templates existed only recorded their content
+	ss := &siteSettings{Template: defaultTemplate}
+
+	if val, ok := cfg[project+":"+contentHashConfigKey]; ok {
+		content, err := contents.get(val.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load site content: %w", err)
+		}
+		ss.Content = content
+	} else if val, ok := cfg[project+":"+legacyContentConfigKey]; ok {
+		content, err := base64.StdEncoding.DecodeString(val.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode site content: %w", err)
+		}
+		ss.Content = &siteContent{Index: string(content)}
+	} else {
+		return nil, errNoRecordedContent
+	}
+
+	if val, ok := cfg[project+":"+templateConfigKey]; ok {
+		ss.Template = val.Value
+	}
+	if val, ok := cfg[project+":"+templateArgsConfigKey]; ok {
+		args, err := base64.StdEncoding.DecodeString(val.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode template args: %w", err)
+		}
+		ss.Args = args
+	}
+	hooks, err := webhooksFrom(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ss.Webhooks = hooks
+	tags, err := tagsFrom(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ss.Tags = tags
+	ss.Domain = domainFrom(cfg)
+	return ss, nil
+}
+
+// webhooksFrom reads the webhooks recorded in the config of an update
+func webhooksFrom(cfg auto.ConfigMap) ([]string, error) {
+	val, ok := cfg[project+":"+webhooksConfigKey]
+	if !ok {
+		return nil, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(val.Value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode webhooks: %w", err)
+	}
+	var hooks []string
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, fmt.Errorf("failed to decode webhooks: %w", err)
+	}
+	return hooks, nil
+}
+
+// tagsFrom reads the tags recorded in the config of an update, or in the stack's current config
+func tagsFrom(cfg auto.ConfigMap) (map[string]string, error) {
+	val, ok := cfg[project+":"+tagsConfigKey]
+	if !ok {
+		return nil, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(val.Value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode tags: %w", err)
+	}
+	var tags map[string]string
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return nil, fmt.Errorf("failed to decode tags: %w", err)
+	}
+	return tags, nil
+}
+
+// lastSiteSettings finds the settings used by the most recent update of a stack
+func lastSiteSettings(ctx context.Context, s siteStack) (*siteSettings, error) {
+	history, err := s.History(ctx, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	// history is ordered newest first. refreshes and destroys don't carry the site's settings.
+	for _, h := range history {
+		if h.Kind != "update" || !hasRecordedContent(h.Config) {
+			continue
+		}
+		return siteSettingsFrom(h.Config)
+	}
+	// a site whose first deployment failed, or that was cloned, has no updates to go on, but its
+	// config still has the settings it was created or cloned with
+	cfg, err := s.GetAllConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if hasRecordedContent(cfg) {
+		return siteSettingsFrom(cfg)
+	}
+	return &siteSettings{Template: defaultTemplate, Domain: domainFrom(cfg)}, nil
+}
+
+// siteWebhooks returns the webhooks recorded by the most recent update of a stack
+func siteWebhooks(ctx context.Context, s siteStack) ([]string, error) {
+	history, err := s.History(ctx, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	return latestWebhooks(history)
+}
+
+func latestWebhooks(history []auto.UpdateSummary) ([]string, error) {
+	for _, h := range history {
+		if h.Kind != "update" || !hasRecordedContent(h.Config) {
+			continue
+		}
+		return webhooksFrom(h.Config)
+	}
+	return nil, nil
+}
+
+func latestTags(history []auto.UpdateSummary) (map[string]string, error) {
+	for _, h := range history {
+		if h.Kind != "update" || !hasRecordedContent(h.Config) {
+			continue
+		}
+		return tagsFrom(h.Config)
+	}
+	return nil, nil
+}
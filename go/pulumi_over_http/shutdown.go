@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// how long to wait for cancelled operations to wind down before giving up on them
+const cancelTimeout = 30 * time.Second
+
+// drain stops the queue from starting new operations and waits up to grace for the running
+// ones to finish. anything still running after that is cancelled.
+func (q *operationQueue) drain(grace time.Duration) {
+	q.mu.Lock()
+	q.draining = true
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(grace):
+	}
+
+	q.cancelRunning()
+	select {
+	case <-done:
+	case <-time.After(cancelTimeout):
+		fmt.Println("gave up waiting for cancelled operations, their stacks may need recovery")
+	}
+}
+
+// cancelRunning asks the backend to cancel the update for every running operation so that
+// its stack isn't left locked, then stops the Pulumi CLI by cancelling the operation's context
+func (q *operationQueue) cancelRunning() {
+	q.mu.Lock()
+	running := make(map[*operation]context.CancelFunc, len(q.running))
+	for op, cancel := range q.running {
+		running[op] = cancel
+	}
+	q.mu.Unlock()
+
+	ctx, cancelCtx := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancelCtx()
+	for op, cancel := range running {
+		stackName := tenantStackName(op.tenant, op.siteID)
+		fmt.Printf("cancelling operation %s (%s %q)\n", op.id, op.kind, stackName)
+		// local backends don't support cancellation, in which case the stack is recovered on the next start
+		s, err := siteStacks.selectStack(ctx, stackName, nil)
+		if err == nil {
+			err = s.Cancel(ctx)
+		}
+		if err != nil {
+			fmt.Printf("failed to cancel the update for stack %q: %v\n", stackName, err)
+		}
+		cancel()
+	}
+}
+
+func (q *operationQueue) isDraining() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.draining
+}
+
+// drainingMiddleware turns away requests that would change a site once the server is shutting down.
+// reads keep working so that callers can follow the operations that are being drained.
+func drainingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" && operations.isDraining() {
+			w.Header().Set("Retry-After", "30")
+			writeError(w, "", errShuttingDown)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
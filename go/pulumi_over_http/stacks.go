@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optpreview"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optrefresh"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// siteStack is the part of auto.Stack the handlers use
+type siteStack interface {
+	Name() string
+	Outputs(ctx context.Context) (auto.OutputMap, error)
+	History(ctx context.Context, pageSize int, page int) ([]auto.UpdateSummary, error)
+	GetAllConfig(ctx context.Context) (auto.ConfigMap, error)
+	SetConfig(ctx context.Context, key string, val auto.ConfigValue) error
+	SetAllConfig(ctx context.Context, config auto.ConfigMap) error
+	RemoveConfig(ctx context.Context, key string) error
+	Up(ctx context.Context, opts ...optup.Option) (auto.UpResult, error)
+	Preview(ctx context.Context, opts ...optpreview.Option) (auto.PreviewResult, error)
+	Refresh(ctx context.Context, opts ...optrefresh.Option) (auto.RefreshResult, error)
+	Destroy(ctx context.Context, opts ...optdestroy.Option) (auto.DestroyResult, error)
+	Cancel(ctx context.Context) error
+	Export(ctx context.Context) (apitype.UntypedDeployment, error)
+	Import(ctx context.Context, state apitype.UntypedDeployment) error
+}
+
+// stackManager creates and selects the stacks behind each site. the handlers only reach stacks
+// through it, so that tests can keep them in memory or in a throwaway backend and run a program
+// that doesn't need any cloud credentials.
+type stackManager interface {
+	// newStack creates a stack, failing with a 409 error if it already exists
+	newStack(ctx context.Context, stackName string, program pulumi.RunFunc) (siteStack, error)
+	// selectStack selects an existing stack, failing with a 404 error if there isn't one
+	selectStack(ctx context.Context, stackName string, program pulumi.RunFunc) (siteStack, error)
+	// setProgram changes the program a stack runs once it's been selected
+	setProgram(s siteStack, program pulumi.RunFunc)
+	// removeStack deletes a stack along with its config and history
+	removeStack(ctx context.Context, stackName string) error
+	// listStacks lists every stack in the backend
+	listStacks(ctx context.Context) ([]auto.StackSummary, error)
+	// workspace returns a workspace for checking that the Pulumi toolchain is usable
+	workspace(ctx context.Context) (auto.Workspace, error)
+}
+
+// siteStacks is the stack manager the handlers use, set up with -stacks-dir
+var siteStacks stackManager = newLocalStackManager("stacks")
+
+// the work directory for the workspace that lists stacks. stack names can't start with a dot,
+// so it never clashes with a stack's own.
+const listWorkDir = ".workspace"
+
+// localStackManager keeps stacks in whichever backend the Pulumi CLI is logged in to, applying
+// opts to every workspace it creates.
+//
+// each stack gets a work directory of its own under dir, which holds the stack's config file.
+// the config is what records a site's region, tags, and expiry between operations, so it has to
+// outlive the workspace, and a directory per stack keeps concurrent operations on different
+// sites from rewriting each other's files.
+type localStackManager struct {
+	dir string
+	// project is written to each work directory the first time it's used
+	project workspace.Project
+	opts    []auto.LocalWorkspaceOption
+
+	// mu guards creating work directories
+	mu sync.Mutex
+}
+
+func newLocalStackManager(dir string) *localStackManager {
+	return &localStackManager{
+		dir: dir,
+		project: workspace.Project{
+			Name:    tokens.PackageName(project),
+			Runtime: workspace.NewProjectRuntimeInfo("go", nil),
+		},
+	}
+}
+
+func (m *localStackManager) newStack(ctx context.Context, stackName string, program pulumi.RunFunc) (siteStack, error) {
+	opts, created, err := m.options(stackName)
+	if err != nil {
+		return nil, err
+	}
+	s, err := auto.NewStackInlineSource(ctx, stackName, project, program, opts...)
+	if err != nil {
+		m.discard(stackName, created)
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (m *localStackManager) selectStack(ctx context.Context, stackName string, program pulumi.RunFunc) (siteStack, error) {
+	opts, created, err := m.options(stackName)
+	if err != nil {
+		return nil, err
+	}
+	s, err := auto.SelectStackInlineSource(ctx, stackName, project, program, opts...)
+	if err != nil {
+		m.discard(stackName, created)
+		return nil, err
+	}
+	if created {
+		if err := restoreConfig(ctx, &s); err != nil {
+			return nil, fmt.Errorf("failed to restore the config of stack %q: %w", stackName, err)
+		}
+	}
+	return &s, nil
+}
+
+// restoreConfig brings back the config of an existing stack whose work directory is new, such
+// as one whose directory was lost or that was created before work directories were kept. the
+// config used for each update is saved with it in the stack's history, so the latest is what
+// the stack last ran with.
+func restoreConfig(ctx context.Context, s siteStack) error {
+	history, err := s.History(ctx, 1, 1)
+	if err != nil {
+		return err
+	}
+	if len(history) == 0 || len(history[0].Config) == 0 {
+		return nil
+	}
+	return s.SetAllConfig(ctx, history[0].Config)
+}
+
+func (m *localStackManager) setProgram(s siteStack, program pulumi.RunFunc) {
+	s.(*auto.Stack).Workspace().SetProgram(program)
+}
+
+func (m *localStackManager) removeStack(ctx context.Context, stackName string) error {
+	opts, _, err := m.options(stackName)
+	if err != nil {
+		return err
+	}
+	ws, err := auto.NewLocalWorkspace(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	if err := ws.RemoveStack(ctx, stackName); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(m.dir, stackName))
+}
+
+func (m *localStackManager) listStacks(ctx context.Context) ([]auto.StackSummary, error) {
+	ws, err := m.workspace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ws.ListStacks(ctx)
+}
+
+// workspace sets up a workspace with only enough information for the stack operations that
+// aren't about any one stack
+func (m *localStackManager) workspace(ctx context.Context) (auto.Workspace, error) {
+	opts, _, err := m.options(listWorkDir)
+	if err != nil {
+		return nil, err
+	}
+	return auto.NewLocalWorkspace(ctx, opts...)
+}
+
+// options returns the options for a workspace in the named work directory, creating it if need
+// be, and whether it was created. opts is copied, since the Automation API appends to the
+// options it's given and stacks are selected from many goroutines at once.
+func (m *localStackManager) options(name string) ([]auto.LocalWorkspaceOption, bool, error) {
+	dir, created, err := m.workDir(name)
+	if err != nil {
+		return nil, false, err
+	}
+	return append(append([]auto.LocalWorkspaceOption(nil), m.opts...), auto.WorkDir(dir)), created, nil
+}
+
+// workDir returns the named work directory, writing the project settings to it the first time.
+// the Automation API leaves existing project settings alone, so they're never rewritten while
+// another operation is reading them.
+func (m *localStackManager) workDir(name string) (string, bool, error) {
+	dir, err := filepath.Abs(filepath.Join(m.dir, name))
+	if err != nil {
+		return "", false, err
+	}
+	settings := filepath.Join(dir, "Pulumi.yaml")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := os.Stat(settings); err == nil {
+		return dir, false, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", false, fmt.Errorf("failed to create work directory for %q: %w", name, err)
+	}
+	if err := m.project.Save(settings); err != nil {
+		return "", false, fmt.Errorf("failed to save project settings for %q: %w", name, err)
+	}
+	return dir, true, nil
+}
+
+// discard removes a work directory that was created for a stack that couldn't be created or
+// selected, so that requests for sites that don't exist don't leave directories behind
+func (m *localStackManager) discard(stackName string, created bool) {
+	if !created {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	os.RemoveAll(filepath.Join(m.dir, stackName))
+}
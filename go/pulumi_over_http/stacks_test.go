@@ -0,0 +1,579 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/events"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optdestroy"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optpreview"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optrefresh"
+	"github.com/pulumi/pulumi/sdk/v3/go/auto/optup"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/workspace"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// fileStackManager keeps stacks in a file:// backend under dir, with secrets encrypted by a
+// passphrase, and swaps every site's program for one that doesn't touch a cloud provider
+type fileStackManager struct {
+	*localStackManager
+}
+
+func newFileStackManager(dir string) *fileStackManager {
+	m := newLocalStackManager(filepath.Join(dir, "stacks"))
+	m.project.Backend = &workspace.ProjectBackend{URL: "file://" + filepath.ToSlash(dir)}
+	m.opts = []auto.LocalWorkspaceOption{
+		auto.PulumiHome(filepath.Join(dir, ".pulumi")),
+		auto.SecretsProvider("passphrase"),
+		auto.EnvVars(map[string]string{
+			"PULUMI_CONFIG_PASSPHRASE": "test",
+			"PULUMI_SKIP_UPDATE_CHECK": "true",
+		}),
+	}
+	return &fileStackManager{m}
+}
+
+func (m *fileStackManager) newStack(ctx context.Context, stackName string, program pulumi.RunFunc) (siteStack, error) {
+	return m.localStackManager.newStack(ctx, stackName, testProgram(program))
+}
+
+func (m *fileStackManager) selectStack(ctx context.Context, stackName string, program pulumi.RunFunc) (siteStack, error) {
+	return m.localStackManager.selectStack(ctx, stackName, testProgram(program))
+}
+
+func (m *fileStackManager) setProgram(s siteStack, program pulumi.RunFunc) {
+	m.localStackManager.setProgram(s, testProgram(program))
+}
+
+// testProgram stands in for a site's program, leaving nil alone for the handlers that don't run one
+func testProgram(program pulumi.RunFunc) pulumi.RunFunc {
+	if program == nil {
+		return nil
+	}
+	return testSiteProgram
+}
+
+// testSiteProgram exports a URL for the site without creating any resources
+func testSiteProgram(ctx *pulumi.Context) error {
+	ctx.Export("websiteUrl", pulumi.Sprintf("http://%s.sites.test", ctx.Stack()))
+	return nil
+}
+
+// requirePulumi skips tests that run stack operations when the Pulumi CLI isn't installed. CI
+// installs it, so there a missing CLI fails the test rather than quietly skipping it.
+func requirePulumi(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("pulumi"); err != nil {
+		if os.Getenv("CI") != "" {
+			t.Fatal("the pulumi CLI is needed to run stack operations")
+		}
+		t.Skip("the pulumi CLI is needed to run stack operations")
+	}
+}
+
+// memStackManager keeps stacks in memory and stands in for the engine, so that the handlers can
+// be tested without the Pulumi CLI. updates run the site's program against mocks, so a program
+// that fails fails the update, and record the config they ran with in the stack's history as
+// the CLI does. the mocks can't see a program's exports, so outputs builds them from the config.
+type memStackManager struct {
+	mu      sync.Mutex
+	stacks  map[string]*memStackState
+	outputs func(stackName string, cfg auto.ConfigMap) auto.OutputMap
+	// changed names the resources that have been changed outside of Pulumi, which refreshes
+	// of any stack holding them report
+	changed map[string]bool
+	// broken names the stacks whose commands fail the way the Automation API's do when it can't
+	// select the stack: before it tails the engine's log, so the event streams are never closed
+	broken map[string]bool
+}
+
+// memStackState is everything the backend knows about a stack
+type memStackState struct {
+	config     auto.ConfigMap
+	outputs    auto.OutputMap
+	history    []auto.UpdateSummary
+	deployment json.RawMessage
+}
+
+func newMemStackManager() *memStackManager {
+	return &memStackManager{stacks: make(map[string]*memStackState), outputs: memOutputs, changed: make(map[string]bool), broken: make(map[string]bool)}
+}
+
+// memOutputs exports the site's URL, and its domain if it has one, as the templates do
+func memOutputs(stackName string, cfg auto.ConfigMap) auto.OutputMap {
+	outs := auto.OutputMap{"websiteUrl": {Value: fmt.Sprintf("http://%s.sites.test", stackName)}}
+	if domain, ok := cfg[project+":"+domainConfigKey]; ok {
+		outs["domain"] = auto.OutputValue{Value: domain.Value}
+		outs["certificateStatus"] = auto.OutputValue{Value: certificatePendingValidation}
+	}
+	return outs
+}
+
+func (m *memStackManager) newStack(ctx context.Context, stackName string, program pulumi.RunFunc) (siteStack, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.stacks[stackName]; ok {
+		return nil, newAPIError(409, codeConflict, "stack %q already exists", stackName)
+	}
+	m.stacks[stackName] = &memStackState{config: auto.ConfigMap{}, deployment: memDeployment(stackName, false)}
+	return &memStack{m: m, name: stackName, program: program}, nil
+}
+
+func (m *memStackManager) selectStack(ctx context.Context, stackName string, program pulumi.RunFunc) (siteStack, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.stacks[stackName]; !ok {
+		return nil, newAPIError(404, codeNotFound, "stack %q not found", stackName)
+	}
+	return &memStack{m: m, name: stackName, program: program}, nil
+}
+
+func (m *memStackManager) setProgram(s siteStack, program pulumi.RunFunc) {
+	s.(*memStack).program = program
+}
+
+func (m *memStackManager) removeStack(ctx context.Context, stackName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st, ok := m.stacks[stackName]
+	if !ok {
+		return newAPIError(404, codeNotFound, "stack %q not found", stackName)
+	}
+	// as `pulumi stack rm` does without --force
+	if resources := memResources(st.deployment); len(resources) > 0 {
+		return fmt.Errorf("stack %q still has %d resources", stackName, len(resources))
+	}
+	delete(m.stacks, stackName)
+	return nil
+}
+
+// change marks a resource as changed outside of Pulumi until the test is done
+func (m *memStackManager) change(t *testing.T, name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.changed[name] = true
+	t.Cleanup(func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.changed, name)
+	})
+}
+
+// breakStack makes the stack's commands fail without closing their event streams until the
+// test is done
+func (m *memStackManager) breakStack(t *testing.T, stackName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.broken[stackName] = true
+	t.Cleanup(func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.broken, stackName)
+	})
+}
+
+// selectErr is the error a broken stack's commands fail with
+func (s *memStack) selectErr() error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	if s.m.broken[s.name] {
+		return fmt.Errorf("failed to select stack %q", s.name)
+	}
+	return nil
+}
+
+func (m *memStackManager) listStacks(ctx context.Context) ([]auto.StackSummary, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var stacks []auto.StackSummary
+	for name, st := range m.stacks {
+		summary := auto.StackSummary{Name: name}
+		if len(st.history) > 0 && st.history[0].EndTime != nil {
+			summary.LastUpdate = *st.history[0].EndTime
+		}
+		stacks = append(stacks, summary)
+	}
+	sort.Slice(stacks, func(i, j int) bool { return stacks[i].Name < stacks[j].Name })
+	return stacks, nil
+}
+
+func (m *memStackManager) workspace(ctx context.Context) (auto.Workspace, error) {
+	return nil, errors.New("the in-memory backend doesn't use the pulumi CLI")
+}
+
+// state returns the stack's state for a test to look at, failing if there's no such stack
+func (m *memStackManager) state(t *testing.T, stackName string) memStackState {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st, ok := m.stacks[stackName]
+	if !ok {
+		t.Fatalf("expected stack %q to exist", stackName)
+	}
+	return *st
+}
+
+// memDeployment is the state of a stack with nothing but its root resource, if it's deployed
+func memDeployment(stackName string, deployed bool) json.RawMessage {
+	resources := "[]"
+	if deployed {
+		resources = fmt.Sprintf(`[
+			{"urn": "urn:pulumi:%[1]s::%[2]s::pulumi:pulumi:Stack::%[2]s-%[1]s", "type": "pulumi:pulumi:Stack", "custom": false},
+			{"urn": "urn:pulumi:%[1]s::%[2]s::aws:s3/bucket:Bucket::site-bucket", "type": "aws:s3/bucket:Bucket", "custom": true}
+		]`, stackName, project)
+	}
+	return json.RawMessage(fmt.Sprintf(`{"manifest": {"time": "2021-04-20T00:00:00Z", "magic": "", "version": "v3.0.0"}, "resources": %s}`, resources))
+}
+
+// memResources returns the URN and type of each resource in a deployment
+func memResources(deployment json.RawMessage) []apitype.ResourceV3 {
+	var d struct {
+		Resources []apitype.ResourceV3 `json:"resources"`
+	}
+	json.Unmarshal(deployment, &d)
+	return d.Resources
+}
+
+// memStack is a stack selected from a memStackManager, along with the program it runs
+type memStack struct {
+	m       *memStackManager
+	name    string
+	program pulumi.RunFunc
+}
+
+// with runs fn against the stack's state, failing if the stack has been removed
+func (s *memStack) with(fn func(st *memStackState) error) error {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	st, ok := s.m.stacks[s.name]
+	if !ok {
+		return newAPIError(404, codeNotFound, "stack %q not found", s.name)
+	}
+	return fn(st)
+}
+
+// record adds an update to the stack's history, with a copy of the config it ran with
+func (s *memStack) record(st *memStackState, kind, message string) auto.UpdateSummary {
+	now := time.Now().UTC().Format(time.RFC3339)
+	cfg := auto.ConfigMap{}
+	for k, v := range st.config {
+		cfg[k] = v
+	}
+	summary := auto.UpdateSummary{
+		Version:   len(st.history) + 1,
+		Kind:      kind,
+		StartTime: now,
+		EndTime:   &now,
+		Message:   message,
+		Config:    cfg,
+		Result:    "succeeded",
+	}
+	st.history = append([]auto.UpdateSummary{summary}, st.history...)
+	return summary
+}
+
+// closeStreams closes the event streams handed to an operation, as the Automation API does
+func closeStreams(streams []chan<- events.EngineEvent) {
+	for _, ch := range streams {
+		close(ch)
+	}
+}
+
+func (s *memStack) Name() string {
+	return s.name
+}
+
+func (s *memStack) Outputs(ctx context.Context) (auto.OutputMap, error) {
+	outs := auto.OutputMap{}
+	err := s.with(func(st *memStackState) error {
+		for k, v := range st.outputs {
+			outs[k] = v
+		}
+		return nil
+	})
+	return outs, err
+}
+
+func (s *memStack) History(ctx context.Context, pageSize int, page int) ([]auto.UpdateSummary, error) {
+	var history []auto.UpdateSummary
+	err := s.with(func(st *memStackState) error {
+		history = append(history, st.history...)
+		return nil
+	})
+	if pageSize > 0 {
+		if page < 1 {
+			page = 1
+		}
+		start := (page - 1) * pageSize
+		if start > len(history) {
+			start = len(history)
+		}
+		end := start + pageSize
+		if end > len(history) {
+			end = len(history)
+		}
+		history = history[start:end]
+	}
+	return history, err
+}
+
+// qualify adds the project's namespace to config keys that don't have one, as the CLI does
+func qualify(key string) string {
+	if strings.Contains(key, ":") {
+		return key
+	}
+	return project + ":" + key
+}
+
+func (s *memStack) GetAllConfig(ctx context.Context) (auto.ConfigMap, error) {
+	cfg := auto.ConfigMap{}
+	err := s.with(func(st *memStackState) error {
+		for k, v := range st.config {
+			cfg[k] = v
+		}
+		return nil
+	})
+	return cfg, err
+}
+
+func (s *memStack) SetConfig(ctx context.Context, key string, val auto.ConfigValue) error {
+	return s.SetAllConfig(ctx, auto.ConfigMap{key: val})
+}
+
+func (s *memStack) SetAllConfig(ctx context.Context, config auto.ConfigMap) error {
+	return s.with(func(st *memStackState) error {
+		for k, v := range config {
+			st.config[qualify(k)] = v
+		}
+		return nil
+	})
+}
+
+func (s *memStack) RemoveConfig(ctx context.Context, key string) error {
+	return s.with(func(st *memStackState) error {
+		delete(st.config, qualify(key))
+		return nil
+	})
+}
+
+// run runs the stack's program against mocks
+func (s *memStack) run(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s.program == nil {
+		return fmt.Errorf("stack %q has no program to run", s.name)
+	}
+	return pulumi.RunErr(s.program, pulumi.WithMocks(project, s.name, newDomainMocks()))
+}
+
+func (s *memStack) Up(ctx context.Context, opts ...optup.Option) (auto.UpResult, error) {
+	upOpts := &optup.Options{}
+	for _, o := range opts {
+		o.ApplyOption(upOpts)
+	}
+	var res auto.UpResult
+	if err := s.selectErr(); err != nil {
+		return res, err
+	}
+	defer closeStreams(upOpts.EventStreams)
+	if err := s.run(ctx); err != nil {
+		return res, fmt.Errorf("failed to run update: %w", err)
+	}
+	err := s.with(func(st *memStackState) error {
+		st.outputs = s.m.outputs(s.name, st.config)
+		st.deployment = memDeployment(s.name, true)
+		res.Summary = s.record(st, "update", upOpts.Message)
+		res.Outputs = auto.OutputMap{}
+		for k, v := range st.outputs {
+			res.Outputs[k] = v
+		}
+		return nil
+	})
+	return res, err
+}
+
+func (s *memStack) Preview(ctx context.Context, opts ...optpreview.Option) (auto.PreviewResult, error) {
+	previewOpts := &optpreview.Options{}
+	for _, o := range opts {
+		o.ApplyOption(previewOpts)
+	}
+	var res auto.PreviewResult
+	if err := s.selectErr(); err != nil {
+		return res, err
+	}
+	defer closeStreams(previewOpts.EventStreams)
+	if err := s.run(ctx); err != nil {
+		return res, fmt.Errorf("failed to run preview: %w", err)
+	}
+	res.ChangeSummary = map[apitype.OpType]int{apitype.OpSame: 1}
+	return res, s.with(func(st *memStackState) error { return nil })
+}
+
+func (s *memStack) Refresh(ctx context.Context, opts ...optrefresh.Option) (auto.RefreshResult, error) {
+	refreshOpts := &optrefresh.Options{}
+	for _, o := range opts {
+		o.ApplyOption(refreshOpts)
+	}
+	var res auto.RefreshResult
+	if err := s.selectErr(); err != nil {
+		return res, err
+	}
+	defer closeStreams(refreshOpts.EventStreams)
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+	// report each of the stack's resources that changed as having new outputs
+	var evts []events.EngineEvent
+	err := s.with(func(st *memStackState) error {
+		for _, r := range memResources(st.deployment) {
+			if !s.m.changed[r.URN.Name().String()] {
+				continue
+			}
+			evts = append(evts, events.EngineEvent{EngineEvent: apitype.EngineEvent{
+				ResOutputsEvent: &apitype.ResOutputsEvent{Metadata: apitype.StepEventMetadata{
+					Op:   apitype.OpRefresh,
+					URN:  string(r.URN),
+					Type: string(r.Type),
+					Old:  &apitype.StepEventStateMetadata{Outputs: map[string]interface{}{"tags": "before"}},
+					New:  &apitype.StepEventStateMetadata{Outputs: map[string]interface{}{"tags": "after"}},
+				}},
+			}})
+		}
+		res.Summary = s.record(st, "refresh", refreshOpts.Message)
+		return nil
+	})
+	for _, e := range evts {
+		for _, ch := range refreshOpts.EventStreams {
+			ch <- e
+		}
+	}
+	return res, err
+}
+
+func (s *memStack) Destroy(ctx context.Context, opts ...optdestroy.Option) (auto.DestroyResult, error) {
+	destroyOpts := &optdestroy.Options{}
+	for _, o := range opts {
+		o.ApplyOption(destroyOpts)
+	}
+	var res auto.DestroyResult
+	if err := s.selectErr(); err != nil {
+		return res, err
+	}
+	defer closeStreams(destroyOpts.EventStreams)
+	if err := ctx.Err(); err != nil {
+		return res, err
+	}
+	err := s.with(func(st *memStackState) error {
+		st.outputs = nil
+		st.deployment = memDeployment(s.name, false)
+		res.Summary = s.record(st, "destroy", destroyOpts.Message)
+		return nil
+	})
+	return res, err
+}
+
+func (s *memStack) Cancel(ctx context.Context) error {
+	return errors.New("the in-memory backend doesn't support cancellation")
+}
+
+func (s *memStack) Export(ctx context.Context) (apitype.UntypedDeployment, error) {
+	state := apitype.UntypedDeployment{Version: 3}
+	err := s.with(func(st *memStackState) error {
+		state.Deployment = append(json.RawMessage(nil), st.deployment...)
+		return nil
+	})
+	return state, err
+}
+
+func (s *memStack) Import(ctx context.Context, state apitype.UntypedDeployment) error {
+	return s.with(func(st *memStackState) error {
+		st.deployment = append(json.RawMessage(nil), state.Deployment...)
+		return nil
+	})
+}
+
+func TestWorkDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	m := newLocalStackManager(dir)
+
+	workDir, created, err := m.workDir("acme.site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || workDir != filepath.Join(dir, "acme.site") {
+		t.Fatalf("expected a new work directory under %s, got %s", dir, workDir)
+	}
+	settings, err := workspace.LoadProject(filepath.Join(workDir, "Pulumi.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(settings.Name) != project {
+		t.Fatalf("expected the project settings to be written, got %+v", settings)
+	}
+
+	// the same stack gets the same directory every time, so its config outlives each workspace
+	again, created, err := m.workDir("acme.site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created || again != workDir {
+		t.Fatalf("expected the existing work directory to be reused, got %s", again)
+	}
+
+	m.discard("acme.site", false)
+	if _, err := os.Stat(workDir); err != nil {
+		t.Fatalf("expected a work directory that was already there to be kept: %v", err)
+	}
+	m.discard("acme.site", true)
+	if _, err := os.Stat(workDir); !os.IsNotExist(err) {
+		t.Fatalf("expected a new work directory to be discarded, got %v", err)
+	}
+}
+
+func TestRestoreConfig(t *testing.T) {
+	ctx := context.Background()
+	m := newMemStackManager()
+	s, err := m.newStack(ctx, "restored", testSiteProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetConfig(ctx, regionConfigKey, auto.ConfigValue{Value: "eu-west-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// a new work directory starts out with no config
+	if err := s.RemoveConfig(ctx, regionConfigKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restoreConfig(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := s.GetAllConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regionFrom(cfg) != "eu-west-1" {
+		t.Fatalf("expected the region to be restored from the last update, got %v", cfg)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/apitype"
+)
+
+// the largest state we'll import. state grows with every resource a site has, so it gets
+// more room than the other JSON bodies.
+const maxStateBytes = 64 << 20
+
+// exports a site's state, in the format of `pulumi stack export`. the export doesn't wait for
+// operations on the site, so that a site stuck part way through an update can still be exported.
+func exportStateHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := context.Background()
+	params := mux.Vars(req)
+	siteID := params["id"]
+	stackName := stackNameFor(req, siteID)
+
+	s, err := siteStacks.selectStack(ctx, stackName, nil)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	state, err := s.Export(ctx)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	version, err := siteVersion(ctx, s)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+
+	response := &SiteState{
+		Version:    state.Version,
+		Deployment: state.Deployment,
+	}
+	w.Header().Set("ETag", siteETag(version))
+	json.NewEncoder(w).Encode(&response)
+}
+
+// replaces a site's state with one exported earlier, such as from another backend or from
+// before the state was corrupted. it waits for the site's queued operations to finish first.
+func importStateHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := context.Background()
+	params := mux.Vars(req)
+	siteID := params["id"]
+	stackName := stackNameFor(req, siteID)
+
+	var state SiteState
+	if err := decodeJSONLimit(req.Body, maxStateBytes, importStateSchema, &state); err != nil {
+		writeErrorf(w, 400, codeBadRequest, siteID, "failed to parse state: %w", err)
+		return
+	}
+	if err := checkStateStack(state.Deployment, stackName); err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+
+	s, err := siteStacks.selectStack(ctx, stackName, nil)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	// turn stale requests away without waiting, then check again once it's our turn
+	if _, ok := checkIfMatch(ctx, w, req, s, siteID); !ok {
+		return
+	}
+	ticket, err := stackLocks.lock(req.Context(), stackName)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	defer ticket.release()
+	if _, ok := checkIfMatch(ctx, w, req, s, siteID); !ok {
+		return
+	}
+
+	err = s.Import(ctx, apitype.UntypedDeployment{
+		Version:    state.Version,
+		Deployment: state.Deployment,
+	})
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	// what we knew about the old state no longer applies
+	driftStatuses.forget(stackName)
+	ops, err := pendingOperations(ctx, s)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	if len(ops) > 0 {
+		recoveries.record(stackName, ops)
+	} else {
+		recoveries.forget(stackName)
+	}
+	writeSite(ctx, w, 200, s, siteID, stackName)
+}
+
+// copies a site's state and config to a new site. the copy manages the same cloud resources as
+// the original, so that a site can be moved to a new ID by cloning it and then deleting the
+// original's stack by hand. deleting either site through the API destroys the resources of both.
+func cloneHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ctx := context.Background()
+	params := mux.Vars(req)
+	siteID := params["id"]
+	stackName := stackNameFor(req, siteID)
+
+	var cloneReq CloneSiteReq
+	if err := decodeJSON(req.Body, cloneSiteSchema, &cloneReq); err != nil {
+		writeErrorf(w, 400, codeBadRequest, siteID, "failed to parse clone request: %w", err)
+		return
+	}
+	cloneName := stackNameFor(req, cloneReq.ID)
+
+	s, err := siteStacks.selectStack(ctx, stackName, nil)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	// wait for the site's queued operations, so that it isn't copied part way through an update
+	ticket, err := stackLocks.lock(req.Context(), stackName)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	defer ticket.release()
+
+	state, err := s.Export(ctx)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	state.Deployment = renameState(state.Deployment, stackName, cloneName)
+	cfg, err := s.GetAllConfig(ctx)
+	if err != nil {
+		writeError(w, siteID, err)
+		return
+	}
+	// the reaper would destroy the original's resources along with the clone's
+	delete(cfg, project+":"+expiresAtConfigKey)
+
+	clone, err := siteStacks.newStack(ctx, cloneName, nil)
+	if err != nil {
+		writeError(w, cloneReq.ID, err)
+		return
+	}
+	if err := clone.SetAllConfig(ctx, cfg); err != nil {
+		siteStacks.removeStack(ctx, cloneName)
+		writeError(w, cloneReq.ID, err)
+		return
+	}
+	if err := clone.Import(ctx, state); err != nil {
+		siteStacks.removeStack(ctx, cloneName)
+		writeError(w, cloneReq.ID, err)
+		return
+	}
+	w.Header().Set("Location", "/sites/"+cloneReq.ID)
+	writeSite(ctx, w, 201, clone, cloneReq.ID, cloneName)
+}
+
+// checkStateStack makes sure every resource in a deployment belongs to the stack it's being
+// imported into. importing another site's state would have this site's next update replace
+// that site's resources.
+func checkStateStack(deployment json.RawMessage, stackName string) error {
+	var d struct {
+		Resources []struct {
+			URN string `json:"urn"`
+		} `json:"resources"`
+	}
+	if err := json.Unmarshal(deployment, &d); err != nil {
+		return badRequest(fmt.Errorf("failed to read deployment: %w", err))
+	}
+	prefix := "urn:pulumi:" + stackName + "::"
+	var problems []string
+	for i, r := range d.Resources {
+		if !strings.HasPrefix(r.URN, prefix) {
+			problems = append(problems, fmt.Sprintf("$.deployment.resources[%d].urn: %q doesn't belong to stack %q", i, r.URN, stackName))
+		}
+	}
+	if len(problems) > 0 {
+		return &schemaError{Problems: problems}
+	}
+	return nil
+}
+
+// renameState points the URNs in a deployment at another stack, as `pulumi stack rename` does,
+// so that the new stack's updates change the existing resources rather than replacing them
+func renameState(deployment json.RawMessage, from, to string) json.RawMessage {
+	renamed := bytes.ReplaceAll(deployment, []byte(`"urn:pulumi:`+from+`::`), []byte(`"urn:pulumi:`+to+`::`))
+	// the root stack resource is named after the stack too
+	return bytes.ReplaceAll(renamed,
+		[]byte(`::pulumi:pulumi:Stack::`+project+`-`+from+`"`),
+		[]byte(`::pulumi:pulumi:Stack::`+project+`-`+to+`"`))
+}
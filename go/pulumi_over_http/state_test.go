@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenameState(t *testing.T) {
+	deployment := json.RawMessage(`{
+		"manifest": {"time": "2021-04-20T00:00:00Z", "magic": "", "version": "v3.0.0"},
+		"resources": [
+			{"urn": "urn:pulumi:acme.old::pulumi_over_http::pulumi:pulumi:Stack::pulumi_over_http-acme.old", "type": "pulumi:pulumi:Stack", "custom": false},
+			{"urn": "urn:pulumi:acme.old::pulumi_over_http::pulumi:providers:aws::default", "type": "pulumi:providers:aws", "custom": true, "id": "0"},
+			{
+				"urn": "urn:pulumi:acme.old::pulumi_over_http::aws:s3/bucket:Bucket::bucket",
+				"type": "aws:s3/bucket:Bucket",
+				"custom": true,
+				"parent": "urn:pulumi:acme.old::pulumi_over_http::pulumi:pulumi:Stack::pulumi_over_http-acme.old",
+				"provider": "urn:pulumi:acme.old::pulumi_over_http::pulumi:providers:aws::default::0",
+				"outputs": {"bucket": "acme.old-bucket"}
+			}
+		]
+	}`)
+	renamed := renameState(deployment, "acme.old", "acme.new")
+
+	var d struct {
+		Resources []struct {
+			URN      string                 `json:"urn"`
+			Parent   string                 `json:"parent"`
+			Provider string                 `json:"provider"`
+			Outputs  map[string]interface{} `json:"outputs"`
+		} `json:"resources"`
+	}
+	if err := json.Unmarshal(renamed, &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Resources[0].URN != "urn:pulumi:acme.new::pulumi_over_http::pulumi:pulumi:Stack::pulumi_over_http-acme.new" {
+		t.Fatalf("expected the root stack resource to be renamed, got %q", d.Resources[0].URN)
+	}
+	bucket := d.Resources[2]
+	if bucket.URN != "urn:pulumi:acme.new::pulumi_over_http::aws:s3/bucket:Bucket::bucket" ||
+		bucket.Parent != d.Resources[0].URN ||
+		bucket.Provider != "urn:pulumi:acme.new::pulumi_over_http::pulumi:providers:aws::default::0" {
+		t.Fatalf("expected every reference to be renamed, got %+v", bucket)
+	}
+	// the stack name showing up in a resource's properties is left alone
+	if bucket.Outputs["bucket"] != "acme.old-bucket" {
+		t.Fatalf("expected the outputs to be unchanged, got %v", bucket.Outputs)
+	}
+	if err := checkStateStack(renamed, "acme.new"); err != nil {
+		t.Fatalf("expected the renamed state to belong to the new stack: %v", err)
+	}
+	if err := checkStateStack(renamed, "acme.old"); err == nil {
+		t.Fatal("expected the renamed state not to belong to the old stack")
+	}
+}
+
+func TestAdminOnly(t *testing.T) {
+	keys := &apiKeyAuthenticator{keys: []apiKey{
+		{Key: "user-key", Name: "user", Tenant: "acme"},
+		{Key: "admin-key", Name: "admin", Tenant: "acme", Admin: true},
+	}}
+	router := newRouter([]authenticator{keys})
+	serve := func(method, path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader("{}"))
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, route := range []string{"GET /sites/a/state", "PUT /sites/a/state", "POST /sites/a/clone"} {
+		parts := strings.SplitN(route, " ", 2)
+		rec := serve(parts[0], parts[1], "user-key")
+		var res ErrorResponse
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		if rec.Code != 403 || res.Code != codeForbidden {
+			t.Errorf("%s: expected a 403 for a caller who isn't an admin, got %d: %s", route, rec.Code, rec.Body)
+		}
+	}
+
+	// admins get past the check, and are then held to the schema like anyone else
+	if rec := serve("PUT", "/sites/a/state", "admin-key"); rec.Code != 400 {
+		t.Fatalf("expected an admin's empty state to be rejected as invalid, got %d: %s", rec.Code, rec.Body)
+	}
+}
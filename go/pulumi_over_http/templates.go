@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/pulumi/pulumi-aws/sdk/v4/go/aws/cloudfront"
+	"github.com/pulumi/pulumi-aws/sdk/v4/go/aws/s3"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// the template used for sites that don't ask for one, and for sites created before templates existed
+const defaultTemplate = "static-site"
+
+// siteTemplate is a named shape of infrastructure that sites can be deployed with.
+// every template's program must export a "websiteUrl" output.
+type siteTemplate struct {
+	Name        string
+	Description string
+	// Schema describes the arguments accepted by the template. args are validated against it
+	// before the program factory ever sees them.
+	Schema *jsonSchema
+	// IgnoresContent is set for templates that don't serve the site's content, so it can be left empty
+	IgnoresContent bool
+	// CustomDomains is set for templates that can serve the site from a custom domain
+	CustomDomains bool
+	// Program decodes the template's typed arguments and builds the pulumi program for a site.
+	// domain is nil unless the site has a custom domain.
+	Program func(args json.RawMessage, content *siteContent, domain *customDomain) (pulumi.RunFunc, error)
+}
+
+var templates = map[string]*siteTemplate{}
+
+// registerTemplate makes a template available to sites. it panics on duplicate names
+// since templates are registered once at startup.
+func registerTemplate(t *siteTemplate) {
+	if _, exists := templates[t.Name]; exists {
+		panic(fmt.Sprintf("template %q registered twice", t.Name))
+	}
+	templates[t.Name] = t
+}
+
+// newProgram validates args against the template's schema and builds the program for a site
+func (t *siteTemplate) newProgram(args json.RawMessage, content *siteContent, domain *customDomain) (pulumi.RunFunc, error) {
+	if domain != nil && !t.CustomDomains {
+		return nil, fmt.Errorf("template %q doesn't support custom domains", t.Name)
+	}
+	if len(args) == 0 {
+		args = json.RawMessage("{}")
+	}
+	if err := t.Schema.validateJSON(args); err != nil {
+		return nil, fmt.Errorf("invalid arguments for template %q: %w", t.Name, err)
+	}
+	return t.Program(args, content, domain)
+}
+
+// lists the templates that sites can be created from
+func listTemplatesHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	response := &ListTemplatesResponse{Templates: []TemplateResponse{}}
+	for _, name := range names {
+		t := templates[name]
+		schema, err := json.Marshal(t.Schema)
+		if err != nil {
+			writeError(w, "", err)
+			return
+		}
+		response.Templates = append(response.Templates, TemplateResponse{
+			Name:        t.Name,
+			Description: t.Description,
+			Schema:      schema,
+		})
+	}
+	json.NewEncoder(w).Encode(&response)
+}
+
+func init() {
+	registerTemplate(&siteTemplate{
+		Name:          "static-site",
+		Description:   "An S3 bucket website serving the content as its index document, or the uploaded files.",
+		Schema:        staticSiteSchema(),
+		CustomDomains: true,
+		Program: func(raw json.RawMessage, content *siteContent, domain *customDomain) (pulumi.RunFunc, error) {
+			args := staticSiteArgs{IndexDocument: "index.html"}
+			if err := json.Unmarshal(raw, &args); err != nil {
+				return nil, err
+			}
+			return createPulumiProgram(content, args, domain), nil
+		},
+	})
+
+	cdnSchema := staticSiteSchema()
+	cdnSchema.Properties["priceClass"] = &jsonSchema{
+		Type:        "string",
+		Description: "The CloudFront price class, which controls the edge locations serving the site.",
+		Enum:        []interface{}{"PriceClass_100", "PriceClass_200", "PriceClass_All"},
+		Default:     "PriceClass_100",
+	}
+	registerTemplate(&siteTemplate{
+		Name:          "static-site-with-cdn",
+		Description:   "A static site served through a CloudFront distribution in front of the S3 bucket website.",
+		Schema:        cdnSchema,
+		CustomDomains: true,
+		Program: func(raw json.RawMessage, content *siteContent, domain *customDomain) (pulumi.RunFunc, error) {
+			args := staticSiteWithCDNArgs{
+				staticSiteArgs: staticSiteArgs{IndexDocument: "index.html"},
+				PriceClass:     "PriceClass_100",
+			}
+			if err := json.Unmarshal(raw, &args); err != nil {
+				return nil, err
+			}
+			return createCDNProgram(content, args, domain), nil
+		},
+	})
+
+	registerTemplate(&siteTemplate{
+		Name:           "redirect-only",
+		Description:    "An S3 bucket website that redirects every request to another host. The content is ignored.",
+		IgnoresContent: true,
+		Schema: &jsonSchema{
+			Type:                 "object",
+			AdditionalProperties: boolPtr(false),
+			Required:             []string{"hostName"},
+			Properties: map[string]*jsonSchema{
+				"hostName": {
+					Type:        "string",
+					Description: "The host to redirect all requests to.",
+					MinLength:   intPtr(1),
+					Pattern:     `^[A-Za-z0-9.-]+$`,
+				},
+				"protocol": {
+					Type:        "string",
+					Description: "The protocol to redirect with. Defaults to the protocol of the original request.",
+					Enum:        []interface{}{"http", "https"},
+				},
+			},
+		},
+		Program: func(raw json.RawMessage, content *siteContent, domain *customDomain) (pulumi.RunFunc, error) {
+			var args redirectArgs
+			if err := json.Unmarshal(raw, &args); err != nil {
+				return nil, err
+			}
+			return createRedirectProgram(args), nil
+		},
+	})
+}
+
+type staticSiteArgs struct {
+	IndexDocument string `json:"indexDocument"`
+	ErrorDocument string `json:"errorDocument"`
+}
+
+func staticSiteSchema() *jsonSchema {
+	return &jsonSchema{
+		Type:                 "object",
+		AdditionalProperties: boolPtr(false),
+		Properties: map[string]*jsonSchema{
+			"indexDocument": {
+				Type:        "string",
+				Description: "The key served as the index of the site. Content sent as JSON is stored under this key.",
+				Default:     "index.html",
+				MinLength:   intPtr(1),
+			},
+			"errorDocument": {
+				Type:        "string",
+				Description: "An optional key to serve for 4XX errors.",
+			},
+		},
+	}
+}
+
+type staticSiteWithCDNArgs struct {
+	staticSiteArgs
+	PriceClass string `json:"priceClass"`
+}
+
+type redirectArgs struct {
+	HostName string `json:"hostName"`
+	Protocol string `json:"protocol"`
+}
+
+// this function defines our pulumi S3 static website in terms of the content that the caller passes in.
+// this allows us to dynamically deploy websites based on user defined values from the POST body.
+func createPulumiProgram(content *siteContent, args staticSiteArgs, domain *customDomain) pulumi.RunFunc {
+	return func(ctx *pulumi.Context) error {
+		siteBucket, err := newSiteBucket(ctx, content, args)
+		if err != nil {
+			return err
+		}
+
+		// custom domains are served over https, which S3 websites can't do on their own
+		if domain != nil {
+			return serveFromCDN(ctx, siteBucket, args.IndexDocument, "PriceClass_100", domain)
+		}
+
+		// export the website URL
+		ctx.Export("websiteUrl", siteBucket.WebsiteEndpoint)
+		return nil
+	}
+}
+
+// createCDNProgram puts a CloudFront distribution in front of the same S3 website as createPulumiProgram
+func createCDNProgram(content *siteContent, args staticSiteWithCDNArgs, domain *customDomain) pulumi.RunFunc {
+	return func(ctx *pulumi.Context) error {
+		siteBucket, err := newSiteBucket(ctx, content, args.staticSiteArgs)
+		if err != nil {
+			return err
+		}
+		return serveFromCDN(ctx, siteBucket, args.IndexDocument, args.PriceClass, domain)
+	}
+}
+
+// serveFromCDN creates a CloudFront distribution in front of the bucket website, served from the
+// custom domain with its own certificate if the site has one
+func serveFromCDN(ctx *pulumi.Context, siteBucket *s3.Bucket, indexDocument, priceClass string, domain *customDomain) error {
+	// S3 website endpoints only speak http, so CloudFront talks to the bucket as a custom origin
+	originID := "s3-website"
+	cdnArgs := &cloudfront.DistributionArgs{
+		Enabled:           pulumi.Bool(true),
+		DefaultRootObject: pulumi.String(indexDocument),
+		PriceClass:        pulumi.String(priceClass),
+		Origins: cloudfront.DistributionOriginArray{
+			&cloudfront.DistributionOriginArgs{
+				OriginId:   pulumi.String(originID),
+				DomainName: siteBucket.WebsiteEndpoint,
+				CustomOriginConfig: &cloudfront.DistributionOriginCustomOriginConfigArgs{
+					HttpPort:             pulumi.Int(80),
+					HttpsPort:            pulumi.Int(443),
+					OriginProtocolPolicy: pulumi.String("http-only"),
+					OriginSslProtocols:   pulumi.StringArray{pulumi.String("TLSv1.2")},
+				},
+			},
+		},
+		DefaultCacheBehavior: &cloudfront.DistributionDefaultCacheBehaviorArgs{
+			TargetOriginId:       pulumi.String(originID),
+			ViewerProtocolPolicy: pulumi.String("redirect-to-https"),
+			AllowedMethods:       pulumi.StringArray{pulumi.String("GET"), pulumi.String("HEAD")},
+			CachedMethods:        pulumi.StringArray{pulumi.String("GET"), pulumi.String("HEAD")},
+			ForwardedValues: &cloudfront.DistributionDefaultCacheBehaviorForwardedValuesArgs{
+				QueryString: pulumi.Bool(false),
+				Cookies: &cloudfront.DistributionDefaultCacheBehaviorForwardedValuesCookiesArgs{
+					Forward: pulumi.String("none"),
+				},
+			},
+		},
+		Restrictions: &cloudfront.DistributionRestrictionsArgs{
+			GeoRestriction: &cloudfront.DistributionRestrictionsGeoRestrictionArgs{
+				RestrictionType: pulumi.String("none"),
+			},
+		},
+		ViewerCertificate: &cloudfront.DistributionViewerCertificateArgs{
+			CloudfrontDefaultCertificate: pulumi.Bool(true),
+		},
+	}
+
+	var zoneID string
+	var cert *domainCertificate
+	if domain != nil {
+		var err error
+		if zoneID, err = lookupZoneID(ctx, domain); err != nil {
+			return err
+		}
+		if cert, err = newDomainCertificate(ctx, domain, zoneID); err != nil {
+			return err
+		}
+		cdnArgs.Aliases = pulumi.StringArray{pulumi.String(domain.Name)}
+		cdnArgs.ViewerCertificate = &cloudfront.DistributionViewerCertificateArgs{
+			AcmCertificateArn:      cert.validatedArn,
+			SslSupportMethod:       pulumi.String("sni-only"),
+			MinimumProtocolVersion: pulumi.String("TLSv1.2_2019"),
+		}
+	}
+
+	cdn, err := cloudfront.NewDistribution(ctx, "cdn", cdnArgs)
+	if err != nil {
+		return err
+	}
+	if domain != nil {
+		if err := addCustomDomain(ctx, domain, zoneID, cdn, cert); err != nil {
+			return err
+		}
+	}
+
+	// the site is served from the CDN, but keep the origin handy for debugging
+	ctx.Export("websiteUrl", cdn.DomainName)
+	ctx.Export("originUrl", siteBucket.WebsiteEndpoint)
+	return nil
+}
+
+// createRedirectProgram defines a bucket website that sends every request somewhere else
+func createRedirectProgram(args redirectArgs) pulumi.RunFunc {
+	return func(ctx *pulumi.Context) error {
+		target := args.HostName
+		if args.Protocol != "" {
+			target = args.Protocol + "://" + target
+		}
+		siteBucket, err := s3.NewBucket(ctx, "s3-website-bucket", &s3.BucketArgs{
+			Website: s3.BucketWebsiteArgs{
+				RedirectAllRequestsTo: pulumi.String(target),
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		ctx.Export("websiteUrl", siteBucket.WebsiteEndpoint)
+		return nil
+	}
+}
+
+// newSiteBucket creates a publicly readable S3 website bucket holding the site's content
+func newSiteBucket(ctx *pulumi.Context, content *siteContent, args staticSiteArgs) (*s3.Bucket, error) {
+	website := s3.BucketWebsiteArgs{
+		IndexDocument: pulumi.String(args.IndexDocument),
+	}
+	if args.ErrorDocument != "" {
+		website.ErrorDocument = pulumi.String(args.ErrorDocument)
+	}
+
+	// our program defines a s3 website.
+	// here we create the bucket
+	siteBucket, err := s3.NewBucket(ctx, "s3-website-bucket", &s3.BucketArgs{
+		Website: website,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// upload each file as its own object
+	objects := content.objects(args.IndexDocument)
+	for _, key := range sortedKeys(objects) {
+		if err := newSiteObject(ctx, siteBucket, key, objects[key], key == args.IndexDocument); err != nil {
+			return nil, err
+		}
+	}
+
+	// Set the access policy for the bucket so all objects are readable.
+	if _, err := s3.NewBucketPolicy(ctx, "bucketPolicy", &s3.BucketPolicyArgs{
+		Bucket: siteBucket.ID(), // refer to the bucket created earlier
+		Policy: pulumi.Any(map[string]interface{}{
+			"Version": "2012-10-17",
+			"Statement": []map[string]interface{}{
+				{
+					"Effect":    "Allow",
+					"Principal": "*",
+					"Action": []interface{}{
+						"s3:GetObject",
+					},
+					"Resource": []interface{}{
+						pulumi.Sprintf("arn:aws:s3:::%s/*", siteBucket.ID()), // policy refers to bucket name explicitly
+					},
+				},
+			},
+		}),
+	}); err != nil {
+		return nil, err
+	}
+
+	return siteBucket, nil
+}
+
+// newSiteObject uploads a single file to the site's bucket
+func newSiteObject(ctx *pulumi.Context, siteBucket *s3.Bucket, key string, data []byte, isIndex bool) error {
+	contentType := contentTypeFor(key)
+	// the index document is HTML unless its extension says otherwise
+	if isIndex && mime.TypeByExtension(path.Ext(key)) == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+
+	objectArgs := &s3.BucketObjectArgs{
+		Bucket:      siteBucket.ID(),            // reference to the s3.Bucket object
+		Key:         pulumi.String(key),         // set the key of the object
+		ContentType: pulumi.String(contentType), // set the MIME type of the file
+	}
+	// binary files like images can't be sent as plain strings
+	if utf8.Valid(data) {
+		objectArgs.Content = pulumi.String(string(data))
+	} else {
+		objectArgs.ContentBase64 = pulumi.String(base64.StdEncoding.EncodeToString(data))
+	}
+
+	// the index document keeps the name it has always had, so sites that move from JSON content
+	// to uploads update the object in place rather than replacing it. other files are namespaced
+	// so their paths can never collide with it.
+	name := "files/" + key
+	if isIndex {
+		name = "index"
+	}
+	_, err := s3.NewBucketObject(ctx, name, objectArgs)
+	return err
+}
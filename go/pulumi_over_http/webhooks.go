@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/auto"
+)
+
+// the most webhooks a single site can register, and the most failed deliveries we hold on to
+const (
+	maxSiteWebhooks    = 10
+	maxWebhookFailures = 1000
+)
+
+// webhookDispatcher POSTs a signed summary of every finished operation to the global webhooks
+// and to those registered for the site. deliveries that keep failing are kept for inspection.
+type webhookDispatcher struct {
+	secret      []byte
+	global      []string
+	maxAttempts int
+	backoff     time.Duration
+	// client delivers to the global webhooks, which the operator chose. siteClient delivers to
+	// the webhooks callers registered, and won't connect to private addresses unless
+	// allowPrivate is set.
+	client       *http.Client
+	siteClient   *http.Client
+	allowPrivate bool
+
+	mu       sync.Mutex
+	failures []*webhookFailure
+}
+
+// webhookFailure is a delivery that ran out of attempts
+type webhookFailure struct {
+	tenant string
+	WebhookFailure
+}
+
+// webhooks delivers operation notifications, set up in main
+var webhooks *webhookDispatcher
+
+func newWebhookDispatcher(secret string, global []string, maxAttempts int, allowPrivate bool) *webhookDispatcher {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	d := &webhookDispatcher{
+		secret:       []byte(secret),
+		global:       global,
+		maxAttempts:  maxAttempts,
+		backoff:      time.Second,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		siteClient:   &http.Client{Timeout: 10 * time.Second},
+		allowPrivate: allowPrivate,
+	}
+	if !allowPrivate {
+		// a hostname can resolve to a public address when it's registered and a private one
+		// when it's delivered to, so the address is checked again as each connection is made.
+		// that covers redirects too. a proxy would make the connection on our behalf, so
+		// there's none.
+		dialer := &net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				return checkWebhookIP(net.ParseIP(host))
+			},
+		}
+		d.siteClient.Transport = &http.Transport{DialContext: dialer.DialContext}
+	}
+	return d
+}
+
+// validateWebhooks checks the webhooks sent with a create or update request
+func validateWebhooks(hooks []string) error {
+	if len(hooks) == 0 {
+		return nil
+	}
+	if len(webhooks.secret) == 0 {
+		return fmt.Errorf("webhooks can't be registered because the server has no -webhook-secret to sign them with")
+	}
+	if len(hooks) > maxSiteWebhooks {
+		return fmt.Errorf("at most %d webhooks can be registered for a site", maxSiteWebhooks)
+	}
+	for _, h := range hooks {
+		if err := validateWebhookURL(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateWebhookURL checks a webhook registered for a site. anyone who can create a site can
+// register one, so unless -webhook-allow-private is set its host must only resolve to public
+// addresses, or the server could be used to reach services that only trust its network.
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q, must be an absolute http or https URL", raw)
+	}
+	if webhooks.allowPrivate {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		return fmt.Errorf("invalid webhook URL %q, failed to resolve its host: %v", raw, err)
+	}
+	for _, addr := range addrs {
+		if err := checkWebhookIP(addr.IP); err != nil {
+			return fmt.Errorf("invalid webhook URL %q: %v", raw, err)
+		}
+	}
+	return nil
+}
+
+// the address ranges that aren't reachable from the internet, other than the loopback and
+// link-local ones net.IP reports itself
+var privateNetworks = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"fc00::/7",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// checkWebhookIP rejects the addresses a site's webhooks mustn't be delivered to
+func checkWebhookIP(ip net.IP) error {
+	if ip == nil {
+		return fmt.Errorf("webhooks can only be delivered to IP addresses")
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%s isn't a public address", ip)
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return fmt.Errorf("%s isn't a public address", ip)
+		}
+	}
+	return nil
+}
+
+// operationFinished sends the result of an operation to every interested webhook in the background
+func (d *webhookDispatcher) operationFinished(op *operation) {
+	payload := op.webhookPayload()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		fmt.Printf("operation %s: failed to encode webhook payload: %v\n", op.id, err)
+		return
+	}
+
+	seen := make(map[string]bool)
+	for i, hooks := range [][]string{d.global, op.webhooks} {
+		client := d.client
+		if i > 0 {
+			client = d.siteClient
+		}
+		for _, h := range hooks {
+			if seen[h] {
+				continue
+			}
+			seen[h] = true
+			go d.deliver(client, op.tenant, h, payload, body)
+		}
+	}
+}
+
+// deliver POSTs the payload to a webhook, retrying with exponential backoff until it's accepted
+// or we run out of attempts, at which point it's added to the failures list
+func (d *webhookDispatcher) deliver(client *http.Client, tenant, hook string, payload *WebhookPayload, body []byte) {
+	var lastErr error
+	delay := d.backoff
+	for attempt := 1; attempt <= d.maxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		lastErr = d.post(client, hook, payload.OperationID, body)
+		if lastErr == nil {
+			return
+		}
+		fmt.Printf("operation %s: webhook %s attempt %d failed: %v\n", payload.OperationID, hook, attempt, lastErr)
+	}
+
+	id, err := newOperationID()
+	if err != nil {
+		id = payload.OperationID
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failures = append(d.failures, &webhookFailure{
+		tenant: tenant,
+		WebhookFailure: WebhookFailure{
+			ID:          id,
+			URL:         hook,
+			OperationID: payload.OperationID,
+			SiteID:      payload.SiteID,
+			Attempts:    d.maxAttempts,
+			LastError:   lastErr.Error(),
+			FailedAt:    time.Now(),
+			Payload:     body,
+		},
+	})
+	// only keep the most recent failures so a dead endpoint can't grow the list forever
+	if len(d.failures) > maxWebhookFailures {
+		d.failures = d.failures[len(d.failures)-maxWebhookFailures:]
+	}
+}
+
+func (d *webhookDispatcher) post(client *http.Client, hook, deliveryID string, body []byte) error {
+	req, err := http.NewRequest("POST", hook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", deliveryID)
+	req.Header.Set("X-Webhook-Signature", d.sign(body))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// sign returns the HMAC-SHA256 of the body in the form "sha256=<hex>", which receivers
+// recompute with the shared secret to check that a notification really came from us
+func (d *webhookDispatcher) sign(body []byte) string {
+	mac := hmac.New(sha256.New, d.secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// failuresFor returns the failed deliveries for a tenant's operations, oldest first
+func (d *webhookDispatcher) failuresFor(tenant string) []WebhookFailure {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res := []WebhookFailure{}
+	for _, f := range d.failures {
+		if f.tenant == tenant {
+			res = append(res, f.WebhookFailure)
+		}
+	}
+	return res
+}
+
+// lists webhook deliveries that failed after every retry
+func webhookFailuresHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	response := &ListWebhookFailuresResponse{
+		Failures: webhooks.failuresFor(callerFrom(req).Tenant),
+	}
+	json.NewEncoder(w).Encode(&response)
+}
+
+// webhookPayload summarizes a finished operation for its webhooks
+func (op *operation) webhookPayload() *WebhookPayload {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	payload := &WebhookPayload{
+		OperationID: op.id,
+		Kind:        op.kind,
+		SiteID:      op.siteID,
+		StackName:   tenantStackName(op.tenant, op.siteID),
+		Result:      op.status,
+		Outputs:     op.outputs,
+	}
+	if op.err != nil {
+		_, payload.Error = errorResponse(op.err, op.siteID)
+	}
+	if op.startedAt != nil && op.finishedAt != nil {
+		payload.StartedAt = *op.startedAt
+		payload.FinishedAt = *op.finishedAt
+		payload.DurationSeconds = op.finishedAt.Sub(*op.startedAt).Seconds()
+	}
+	return payload
+}
+
+// setOutputs records the stack outputs produced by an operation so that they can be sent to
+// its webhooks. secret values are never sent anywhere.
+func (op *operation) setOutputs(outs auto.OutputMap) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.outputs = make(map[string]interface{}, len(outs))
+	for k, v := range outs {
+		if v.Secret {
+			op.outputs[k] = "[secret]"
+			continue
+		}
+		op.outputs[k] = v.Value
+	}
+}
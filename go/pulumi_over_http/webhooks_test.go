@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateWebhookURL(t *testing.T) {
+	saved := webhooks
+	defer func() { webhooks = saved }()
+	webhooks = newWebhookDispatcher("secret", nil, 1, false)
+
+	for _, hook := range []string{
+		"http://127.0.0.1/hook",
+		"http://localhost:8080/hook",
+		"http://[::1]/hook",
+		"http://0.0.0.0/hook",
+		"http://10.1.2.3/hook",
+		"http://172.16.0.1/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[fd00::1]/hook",
+		"http://[::ffff:127.0.0.1]/hook",
+	} {
+		if err := validateWebhooks([]string{hook}); err == nil {
+			t.Errorf("expected %s to be rejected", hook)
+		}
+	}
+	if err := validateWebhooks([]string{"https://93.184.216.34/hook"}); err != nil {
+		t.Errorf("expected a public address to be allowed: %v", err)
+	}
+
+	webhooks = newWebhookDispatcher("secret", nil, 1, true)
+	if err := validateWebhooks([]string{"http://127.0.0.1/hook"}); err != nil {
+		t.Errorf("expected private addresses to be allowed with -webhook-allow-private: %v", err)
+	}
+}
+
+// a site's webhooks are checked again as they're delivered, since their host may have resolved
+// to a public address when they were registered. the operator's global webhooks aren't.
+func TestWebhookDeliveryToPrivateAddress(t *testing.T) {
+	delivered := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		delivered++
+	}))
+	defer receiver.Close()
+
+	d := newWebhookDispatcher("secret", []string{receiver.URL}, 1, false)
+	if err := d.post(d.siteClient, receiver.URL, "delivery", []byte("{}")); err == nil {
+		t.Fatal("expected delivery of a site's webhook to a loopback address to fail")
+	}
+	if err := d.post(d.client, receiver.URL, "delivery", []byte("{}")); err != nil {
+		t.Fatalf("expected delivery to a global webhook to succeed: %v", err)
+	}
+	if delivered != 1 {
+		t.Fatalf("expected exactly one delivery, got %d", delivered)
+	}
+}